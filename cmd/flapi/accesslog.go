@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/urfave/negroni"
+)
+
+const (
+	accessLogText   = "text"
+	accessLogJSON   = "json"
+	accessLogFmt    = "logfmt"
+	accessLogApache = "apache"
+	accessLogNone   = "none"
+
+	defaultAccessLogFormat = accessLogText
+	defaultAccessLogOutput = "stdout"
+)
+
+// accessLogEntry is the access log entry of a request.
+type accessLogEntry struct {
+	service    string
+	time       time.Time
+	method     string
+	route      string
+	uri        string
+	proto      string
+	status     int
+	latency    time.Duration
+	bytes      int
+	remoteAddr string
+	requestID  string
+	traceID    string
+	referer    string
+	userAgent  string
+	chaos      []string
+
+	sync.Mutex
+}
+
+// addChaos records a chaos injection into the request processing. Since chain targets can be requested concurrently,
+// injections can be recorded concurrently.
+func (e *accessLogEntry) addChaos(chaos string) {
+	e.Lock()
+	e.chaos = append(e.chaos, chaos)
+	e.Unlock()
+}
+
+// accessLog is a Negroni middleware logging the requests handled by the service.
+type accessLog struct {
+	format string
+	output io.WriteCloser
+
+	sync.Mutex
+}
+
+func newAccessLog() *accessLog {
+	return &accessLog{format: accessLogNone}
+}
+
+// checkAccessLogConfig checks that the access log configuration is valid.
+func checkAccessLogConfig(config *configAccessLog) error {
+	switch config.Format {
+	case accessLogText, accessLogJSON, accessLogFmt, accessLogApache, accessLogNone:
+	default:
+		return fmt.Errorf("unsupported format %q", config.Format)
+	}
+
+	if config.Output == "" {
+		return fmt.Errorf("output not specified")
+	}
+
+	if config.MaxSize < 0 || config.MaxBackups < 0 {
+		return fmt.Errorf("rotation settings must be positive")
+	}
+
+	return nil
+}
+
+// openAccessLogOutput opens the access log output defined in the access log configuration.
+func openAccessLogOutput(config *configAccessLog) (io.WriteCloser, error) {
+	switch config.Output {
+	case "stdout":
+		return nopWriteCloser{os.Stdout}, nil
+	case "stderr":
+		return nopWriteCloser{os.Stderr}, nil
+	}
+
+	return newRotatingFile(config.Output, int64(config.MaxSize)*1024*1024, config.MaxBackups)
+}
+
+// configure sets the access log format and replaces the current access log output by output.
+func (l *accessLog) configure(format string, output io.WriteCloser) {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.output != nil {
+		l.output.Close()
+	}
+
+	l.format = format
+	l.output = output
+}
+
+func (l *accessLog) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	entry := accessLogEntry{
+		time:      time.Now(),
+		method:    r.Method,
+		route:     requestRoute(r),
+		uri:       r.RequestURI,
+		proto:     r.Proto,
+		requestID: r.Header.Get(requestIDHeader),
+		traceID:   traceID(r),
+		referer:   r.Referer(),
+		userAgent: r.UserAgent(),
+	}
+
+	entry.service, _ = r.Context().Value(serviceContextKey).(string)
+
+	if entry.remoteAddr, _, _ = net.SplitHostPort(r.RemoteAddr); entry.remoteAddr == "" {
+		entry.remoteAddr = r.RemoteAddr
+	}
+
+	next(rw, r.WithContext(context.WithValue(r.Context(), accessLogContextKey, &entry)))
+
+	res := rw.(negroni.ResponseWriter)
+
+	entry.latency = time.Since(entry.time)
+	entry.status = res.Status()
+	entry.bytes = res.Size()
+
+	l.write(&entry)
+}
+
+func (l *accessLog) write(entry *accessLogEntry) {
+	var buf bytes.Buffer
+
+	l.Lock()
+	defer l.Unlock()
+
+	entry.Lock()
+	defer entry.Unlock()
+
+	switch l.format {
+	case accessLogNone:
+		return
+
+	case accessLogJSON:
+		v := map[string]interface{}{
+			"time":        entry.time.Format(time.RFC3339Nano),
+			"method":      entry.method,
+			"route":       entry.route,
+			"uri":         entry.uri,
+			"status":      entry.status,
+			"latency":     entry.latency.Seconds(),
+			"bytes":       entry.bytes,
+			"remote_addr": entry.remoteAddr,
+			"request_id":  entry.requestID,
+			"user_agent":  entry.userAgent,
+		}
+
+		if entry.service != "" {
+			v["service"] = entry.service
+		}
+
+		if entry.traceID != "" {
+			v["trace_id"] = entry.traceID
+		}
+
+		if len(entry.chaos) > 0 {
+			v["chaos"] = entry.chaos
+		}
+
+		json.NewEncoder(&buf).Encode(v)
+
+	case accessLogFmt:
+		fields := []string{
+			"time", entry.time.Format(time.RFC3339Nano),
+			"method", entry.method,
+			"route", entry.route,
+			"uri", entry.uri,
+			"status", strconv.Itoa(entry.status),
+			"latency", strconv.FormatFloat(entry.latency.Seconds(), 'f', -1, 64),
+			"bytes", strconv.Itoa(entry.bytes),
+			"remote_addr", entry.remoteAddr,
+			"request_id", entry.requestID,
+			"trace_id", entry.traceID,
+			"user_agent", entry.userAgent,
+			"chaos", strings.Join(entry.chaos, ","),
+		}
+
+		if entry.service != "" {
+			fields = append([]string{"service", entry.service}, fields...)
+		}
+
+		for i := 0; i < len(fields); i += 2 {
+			if i > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(fields[i] + "=" + logfmtValue(fields[i+1]))
+		}
+		buf.WriteByte('\n')
+
+	case accessLogApache:
+		// Combined Log Format, followed by the request ID, trace ID and injected chaos. The service name is
+		// prepended if any, as in the virtual host Combined Log Format.
+		if entry.service != "" {
+			buf.WriteString(entry.service + " ")
+		}
+
+		fmt.Fprintf(&buf, "%s - - [%s] %q %d %d %q %q %q %q %q\n",
+			entry.remoteAddr,
+			entry.time.Format("02/Jan/2006:15:04:05 -0700"),
+			entry.method+" "+entry.uri+" "+entry.proto,
+			entry.status,
+			entry.bytes,
+			dashIfEmpty(entry.referer),
+			dashIfEmpty(entry.userAgent),
+			dashIfEmpty(entry.requestID),
+			dashIfEmpty(entry.traceID),
+			dashIfEmpty(strings.Join(entry.chaos, ",")),
+		)
+
+	default:
+		buf.WriteString("[access] ")
+		if entry.service != "" {
+			buf.WriteString(entry.service + " | ")
+		}
+
+		fmt.Fprintf(&buf, "%s | %d | \t %s | %s | %s %s",
+			entry.time.Format(time.RFC3339),
+			entry.status,
+			entry.latency,
+			entry.remoteAddr,
+			entry.method,
+			entry.uri,
+		)
+		if len(entry.chaos) > 0 {
+			fmt.Fprintf(&buf, " | chaos: %s", strings.Join(entry.chaos, ", "))
+		}
+		buf.WriteByte('\n')
+	}
+
+	if _, err := l.output.Write(buf.Bytes()); err != nil {
+		log.Error("unable to write access log entry: %s", err)
+	}
+}
+
+// logfmtValue returns v quoted if it contains characters that are not allowed in logfmt unquoted values.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " =\"\\\t\n") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+func dashIfEmpty(v string) string {
+	if v == "" {
+		return "-"
+	}
+
+	return v
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// rotatingFile is a file rotated once its size exceeds maxSize bytes, keeping at most maxBackups previous files
+// (suffixed by ".1", ".2"...). The file is never rotated if maxSize is 0.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	file       *os.File
+}
+
+func newRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := rotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return &f, nil
+}
+
+func (f *rotatingFile) open() error {
+	var err error
+
+	if f.file, err = os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+
+	info, err := f.file.Stat()
+	if err != nil {
+		f.file.Close()
+		f.file = nil
+		return err
+	}
+	f.size = info.Size()
+
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	// The file is not open if reopening it failed during the last rotation
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			// Rotation is attempted again once maxSize more bytes have been written to the unrotated file
+			log.Warning("unable to rotate file %s: %s", f.path, err)
+			f.size = 0
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// rotate renames the file to the first backup, shifting the previous backups. The file at path is reopened whatever
+// the rotation outcome, so that writing continues to the unrotated file if it failed.
+func (f *rotatingFile) rotate() error {
+	var err error
+
+	f.file.Close()
+
+	if f.maxBackups == 0 {
+		err = os.Remove(f.path)
+	} else {
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+		}
+
+		err = os.Rename(f.path, f.path+".1")
+	}
+
+	if oerr := f.open(); oerr != nil {
+		return oerr
+	}
+
+	return err
+}
+
+func (f *rotatingFile) Close() error {
+	return f.file.Close()
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/facette/httputil"
+	"gopkg.in/yaml.v2"
+)
+
+// parseEndpointSpec returns an endpoint configuration from its JSON representation, as emitted by the endpoints
+// listing.
+func parseEndpointSpec(r io.Reader) (*configEndpoint, error) {
+	var spec struct {
+		configEndpoint `yaml:",inline"`
+
+		Targets []configEndpointTarget `yaml:"targets"`
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON being a subset of YAML, the endpoint specification is decoded using the configuration file structures
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		return nil, err
+	}
+
+	if spec.Targets != nil {
+		spec.Chain = spec.Targets
+	}
+
+	if !strings.HasPrefix(spec.Route, apiPrefix+"/") {
+		return nil, fmt.Errorf("route must start with %s/", apiPrefix)
+	}
+	spec.Route = strings.TrimPrefix(spec.Route, apiPrefix)
+
+	return &spec.configEndpoint, nil
+}
+
+func (s *service) createEndpoint(rw http.ResponseWriter, r *http.Request) {
+	s.putEndpoint(rw, r, false)
+}
+
+func (s *service) updateEndpoint(rw http.ResponseWriter, r *http.Request) {
+	s.putEndpoint(rw, r, true)
+}
+
+// putEndpoint adds the endpoint specified in the request body to the service API endpoints, along with its chaos
+// specifications. If an endpoint with the same method and route already exists, it is replaced if replace is true.
+func (s *service) putEndpoint(rw http.ResponseWriter, r *http.Request, replace bool) {
+	config, err := parseEndpointSpec(r.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	e, err := newEndpoint(config, s.chaos)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid endpoint: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	specs, err := endpointChaosSpecs(config, e)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid endpoint %s", err), http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var replaced *endpoint
+
+	status := http.StatusCreated
+	endpoints := make([]*endpoint, 0, len(s.endpoints)+1)
+	for _, cur := range s.endpoints {
+		if cur.method == e.method && cur.route == e.route {
+			if !replace {
+				http.Error(rw, "Endpoint already exists", http.StatusConflict)
+				return
+			}
+
+			endpoints = append(endpoints, e)
+			replaced = cur
+			status = http.StatusOK
+			continue
+		}
+
+		endpoints = append(endpoints, cur)
+	}
+
+	if status == http.StatusCreated {
+		endpoints = append(endpoints, e)
+	}
+
+	if err := checkEndpointsRoutes(endpoints); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	if replaced != nil {
+		s.chaos.controller.delEndpointSpecs(replaced)
+	}
+
+	s.setEndpoints(endpoints)
+
+	// The endpoint chaos specifications are set as if using the chaos management API
+	for _, rs := range specs {
+		s.chaos.controller.setSpec(rs.method, rs.path, rs.spec)
+	}
+
+	if status == http.StatusCreated {
+		log.Info("registered API endpoint %s", e)
+	} else {
+		log.Info("updated API endpoint %s", e)
+	}
+
+	httputil.WriteJSON(rw, e, status)
+}
+
+func (s *service) deleteEndpoint(rw http.ResponseWriter, r *http.Request) {
+	var (
+		method string
+		route  string
+	)
+
+	// Resource endpoints don't have a method
+	method = r.URL.Query().Get("method")
+
+	if route = r.URL.Query().Get("route"); route == "" {
+		http.Error(rw, "Missing value for route parameter", http.StatusBadRequest)
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	var removed *endpoint
+
+	endpoints := make([]*endpoint, 0, len(s.endpoints))
+	for _, cur := range s.endpoints {
+		if cur.method != method || cur.route != route {
+			endpoints = append(endpoints, cur)
+		} else {
+			removed = cur
+		}
+	}
+
+	if removed == nil {
+		http.Error(rw, "No such endpoint", http.StatusNotFound)
+		return
+	}
+
+	s.chaos.controller.delEndpointSpecs(removed)
+	s.setEndpoints(endpoints)
+	log.Info("unregistered API endpoint %s", strings.TrimSpace(method+" "+route))
+
+	rw.WriteHeader(http.StatusNoContent)
+}
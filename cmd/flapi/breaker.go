@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	breakerClosed = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+const (
+	defaultBreakerFailureRate  = 0.5
+	defaultBreakerMinRequests  = 10
+	defaultBreakerOpenDuration = 30 * time.Second
+	defaultBreakerOpenStatus   = http.StatusServiceUnavailable
+	defaultBreakerWindow       = 10 * time.Second
+)
+
+var breakerStates = map[int]string{
+	breakerClosed:   "closed",
+	breakerHalfOpen: "half-open",
+	breakerOpen:     "open",
+}
+
+// circuitBreaker prevents requests to a failing chain target: once the failure rate observed over the breaker window
+// reaches the configured threshold the breaker opens, and requests fail fast until the open duration expires. The
+// breaker then lets a single probe request through (half-open state), closing it back if the probe succeeds.
+type circuitBreaker struct {
+	target       string
+	failureRate  float64
+	minRequests  int
+	openDuration time.Duration
+	openStatus   int
+	window       time.Duration
+
+	state       int
+	openedAt    time.Time
+	windowStart time.Time
+	requests    int
+	failures    int
+	probing     bool
+
+	sync.Mutex
+}
+
+func newCircuitBreaker(target string, config *configCircuitBreaker) (*circuitBreaker, error) {
+	b := circuitBreaker{
+		target:       target,
+		failureRate:  defaultBreakerFailureRate,
+		minRequests:  defaultBreakerMinRequests,
+		openDuration: defaultBreakerOpenDuration,
+		openStatus:   defaultBreakerOpenStatus,
+		window:       defaultBreakerWindow,
+		windowStart:  time.Now(),
+	}
+
+	if config.FailureRate < 0 || config.FailureRate > 1 {
+		return nil, fmt.Errorf("failure rate value must be 0 < rate <= 1")
+	} else if config.FailureRate > 0 {
+		b.failureRate = config.FailureRate
+	}
+
+	if config.MinRequests < 0 {
+		return nil, fmt.Errorf("minimum requests must be positive")
+	} else if config.MinRequests > 0 {
+		b.minRequests = config.MinRequests
+	}
+
+	if config.OpenDuration < 0 {
+		return nil, fmt.Errorf("open duration must be positive")
+	} else if config.OpenDuration > 0 {
+		b.openDuration = config.OpenDuration
+	}
+
+	if config.OpenStatus != 0 {
+		if config.OpenStatus < 100 || config.OpenStatus > 599 {
+			return nil, fmt.Errorf("invalid open status code")
+		}
+		b.openStatus = config.OpenStatus
+	}
+
+	return &b, nil
+}
+
+func (b *circuitBreaker) setState(state int) {
+	if state == b.state {
+		return
+	}
+
+	log.Info("circuit breaker for target endpoint %s: %s -> %s", b.target, breakerStates[b.state],
+		breakerStates[state])
+
+	b.state = state
+	b.probing = false
+	b.requests = 0
+	b.failures = 0
+	b.windowStart = time.Now()
+
+	if state == breakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+// update switches an open breaker to half-open once its open duration has expired. It must be called with the
+// breaker lock held.
+func (b *circuitBreaker) update() {
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.openDuration {
+		b.setState(breakerHalfOpen)
+	}
+}
+
+// currentState returns the current breaker state.
+func (b *circuitBreaker) currentState() int {
+	b.Lock()
+	defer b.Unlock()
+
+	b.update()
+
+	return b.state
+}
+
+// allow returns true if a request to the target is allowed by the breaker.
+func (b *circuitBreaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.update()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+
+	case breakerHalfOpen:
+		if !b.probing {
+			b.probing = true
+			return true
+		}
+	}
+
+	return false
+}
+
+// record accounts for the outcome of a request allowed by the breaker.
+func (b *circuitBreaker) record(success bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if success {
+			b.setState(breakerClosed)
+		} else {
+			b.setState(breakerOpen)
+		}
+
+	case breakerClosed:
+		if time.Since(b.windowStart) > b.window {
+			b.windowStart = time.Now()
+			b.requests = 0
+			b.failures = 0
+		}
+
+		b.requests++
+		if !success {
+			b.failures++
+		}
+
+		if b.requests >= b.minRequests && float64(b.failures)/float64(b.requests) >= b.failureRate {
+			b.setState(breakerOpen)
+		}
+	}
+}
+
+// release gives back a request allowed by the breaker which outcome is unknown (e.g. cancelled request).
+func (b *circuitBreaker) release() {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.state == breakerHalfOpen {
+		b.probing = false
+	}
+}
+
+func (b *circuitBreaker) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"state":         breakerStates[b.currentState()],
+		"failure_rate":  b.failureRate,
+		"min_requests":  b.minRequests,
+		"open_duration": b.openDuration.String(),
+		"open_status":   b.openStatus,
+	})
+}
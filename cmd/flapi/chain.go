@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const (
+	chainModeSequential = "sequential"
+	chainModeParallel   = "parallel"
+	chainModeRace       = "race"
+	chainModeQuorum     = "quorum"
+)
+
+// chainMode describes how an endpoint requests its chain targets and how the final response status is computed.
+type chainMode struct {
+	kind   string
+	quorum int
+}
+
+func parseChainMode(mode string, targets int) (chainMode, error) {
+	switch {
+	case mode == "", mode == chainModeSequential:
+		return chainMode{kind: chainModeSequential}, nil
+
+	case mode == chainModeParallel:
+		return chainMode{kind: chainModeParallel}, nil
+
+	case mode == chainModeRace:
+		return chainMode{kind: chainModeRace, quorum: 1}, nil
+
+	case strings.HasPrefix(mode, chainModeQuorum+":"):
+		n, err := strconv.Atoi(strings.TrimPrefix(mode, chainModeQuorum+":"))
+		if err != nil {
+			return chainMode{}, fmt.Errorf("invalid quorum value: %s", err)
+		}
+
+		if n < 1 || n > targets {
+			return chainMode{}, fmt.Errorf("quorum value must be between 1 and the number of chain targets (%d)",
+				targets)
+		}
+
+		return chainMode{kind: chainModeQuorum, quorum: n}, nil
+	}
+
+	return chainMode{}, fmt.Errorf("unsupported chain mode %q", mode)
+}
+
+func (m chainMode) String() string {
+	if m.kind == chainModeQuorum {
+		return fmt.Sprintf("%s:%d", m.kind, m.quorum)
+	}
+
+	return m.kind
+}
+
+// targetAttempt represents the outcome of a single request attempt to a chain target.
+type targetAttempt struct {
+	status   string
+	code     int
+	body     string
+	err      error
+	rejected bool
+}
+
+func (a *targetAttempt) String() string {
+	if a.err != nil {
+		return fmt.Sprintf("error: %s", a.err)
+	}
+
+	return fmt.Sprintf("HTTP %s: %s", a.status, a.body)
+}
+
+// targetResult represents the outcome of a request to a chain target, including its retries.
+type targetResult struct {
+	index     int
+	attempts  []*targetAttempt
+	cancelled bool
+}
+
+func (r *targetResult) last() *targetAttempt {
+	return r.attempts[len(r.attempts)-1]
+}
+
+// ok returns true if the target last attempt returned a non-server error status.
+func (r *targetResult) ok() bool {
+	return r.last().err == nil && r.last().code < 500
+}
+
+func (r *targetResult) String() string {
+	attempts := make([]string, len(r.attempts))
+	for i, a := range r.attempts {
+		attempts[i] = a.String()
+	}
+
+	if r.cancelled {
+		attempts[len(attempts)-1] = "cancelled"
+	}
+
+	if len(attempts) > 1 {
+		for i := range attempts {
+			attempts[i] = fmt.Sprintf("attempt %d: %s", i+1, attempts[i])
+		}
+	}
+
+	return strings.Join(attempts, "; ")
+}
+
+func attemptTarget(ctx context.Context, t *endpointTarget) *targetAttempt {
+	var attempt targetAttempt
+
+	ctx, span := trace.StartSpan(ctx, t.method+" "+t.rawURL)
+	span.SetAttributes(
+		trace.StringAttribute{Key: spanKindAttribute, Value: spanKindClient},
+		trace.StringAttribute{Key: "http.method", Value: t.method},
+		trace.StringAttribute{Key: "http.url", Value: expandRouteVars(ctx, t.rawURL)},
+	)
+	if name, ok := ctx.Value(serviceContextKey).(string); ok {
+		span.SetAttributes(trace.StringAttribute{Key: spanServiceAttribute, Value: name})
+	}
+	defer endTargetAttempt(ctx, t, span, &attempt, time.Now())
+
+	if t.breaker != nil {
+		if !t.breaker.allow() {
+			attempt.rejected = true
+			attempt.code = t.breaker.openStatus
+			attempt.status = fmt.Sprintf("%d %s", attempt.code, http.StatusText(attempt.code))
+			attempt.body = "circuit breaker open"
+			span.Annotate(nil, "circuit breaker open")
+			return &attempt
+		}
+
+		defer func(ctx context.Context) {
+			if ctx.Err() == context.Canceled {
+				t.breaker.release()
+			} else {
+				t.breaker.record(attempt.err == nil && attempt.code < 500)
+			}
+		}(ctx)
+	}
+
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+
+	res, err := t.request(ctx)
+	if err != nil {
+		attempt.err = err
+		return &attempt
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		attempt.err = err
+		return &attempt
+	}
+
+	attempt.status = res.Status
+	attempt.code = res.StatusCode
+	attempt.body = strings.TrimSpace(string(data))
+
+	return &attempt
+}
+
+// endTargetAttempt ends the span of a chain target request attempt started at start, recording the attempt outcome
+// in the span and the chain targets metrics.
+func endTargetAttempt(ctx context.Context, t *endpointTarget, span *trace.Span, attempt *targetAttempt,
+	start time.Time) {
+	if mw, ok := ctx.Value(metricsContextKey).(*metricsMiddleware); ok {
+		mw.recordTargetAttempt(ctx, t, attempt, time.Since(start))
+	}
+
+	switch {
+	case attempt.err != nil:
+		span.SetStatus(trace.Status{Code: traceStatusUnknown, Message: attempt.err.Error()})
+
+	case attempt.code > 0:
+		span.SetAttributes(trace.Int64Attribute{Key: "http.status_code", Value: int64(attempt.code)})
+		if attempt.code >= 500 {
+			span.SetStatus(trace.Status{Code: traceStatusUnknown, Message: http.StatusText(attempt.code)})
+		}
+	}
+
+	span.End()
+}
+
+// requestTarget requests a chain target, retrying failed attempts according to the target retry policy as long as
+// the endpoint retry budget allows it.
+func requestTarget(ctx context.Context, index int, t *endpointTarget) *targetResult {
+	result := targetResult{index: index}
+
+	if t.budget != nil {
+		t.budget.request()
+	}
+
+	for n := 0; ; n++ {
+		if n > 0 {
+			select {
+			case <-time.After(t.backoff.delay(n)):
+			case <-ctx.Done():
+				return &result
+			}
+		}
+
+		attempt := attemptTarget(ctx, t)
+		result.attempts = append(result.attempts, attempt)
+
+		if n >= t.retries || ctx.Err() != nil || attempt.rejected ||
+			(attempt.err == nil && !t.retryOn[attempt.code]) {
+			break
+		}
+
+		if t.budget != nil && !t.budget.withdraw() {
+			log.Debug("retry budget exhausted for target endpoint %s %s", t.method, t.rawURL)
+			break
+		}
+	}
+
+	return &result
+}
+
+// requestChain requests the endpoint chain targets according to the endpoint chain mode, and returns the final
+// response status along with the targets responses reported in declaration order.
+func (e *endpoint) requestChain(ctx context.Context) (int, []string) {
+	var results []*targetResult
+
+	switch e.chainMode.kind {
+	case chainModeSequential:
+		results = make([]*targetResult, len(e.targets))
+		for i := range e.targets {
+			results[i] = requestTarget(ctx, i, e.targets[i])
+		}
+
+	default:
+		results = e.fanOut(ctx)
+	}
+
+	finalStatus := http.StatusOK
+	succeeded := 0
+	responses := make([]string, len(results))
+
+	for i, r := range results {
+		responses[i] = r.String()
+
+		if r.ok() {
+			succeeded++
+		} else if r.last().err != nil && !r.cancelled && e.chainMode.quorum == 0 {
+			finalStatus = http.StatusInternalServerError
+		}
+	}
+
+	if e.chainMode.quorum > 0 && succeeded < e.chainMode.quorum {
+		finalStatus = http.StatusInternalServerError
+	}
+
+	return finalStatus, responses
+}
+
+// fanOut requests all the endpoint chain targets concurrently. In race and quorum modes, the pending requests are
+// cancelled as soon as enough targets have succeeded.
+func (e *endpoint) fanOut(ctx context.Context) []*targetResult {
+	var (
+		results   = make([]*targetResult, len(e.targets))
+		resChan   = make(chan *targetResult, len(e.targets))
+		succeeded = 0
+	)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for i := range e.targets {
+		go func(i int) { resChan <- requestTarget(ctx, i, e.targets[i]) }(i)
+	}
+
+	for range e.targets {
+		r := <-resChan
+
+		if r.last().err != nil && e.chainMode.quorum > 0 && succeeded >= e.chainMode.quorum {
+			r.cancelled = true
+		}
+
+		if r.ok() {
+			if succeeded++; e.chainMode.quorum > 0 && succeeded == e.chainMode.quorum {
+				log.Debug("chain %s reached for %s %s, cancelling pending targets", e.chainMode, e.method, e.route)
+				cancel()
+			}
+		}
+
+		results[r.index] = r
+	}
+
+	return results
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestChaos returns a chaos middleware without management controller listener, suitable for creating endpoints.
+func newTestChaos() *chaos {
+	return &chaos{
+		controller: &chaosController{
+			routes:    make(map[string]*chaosSpec),
+			scenarios: make(map[string]*chaosScenario),
+		},
+	}
+}
+
+// newTestTarget returns a test HTTP server responding with status, or never responding until the request is
+// cancelled if status is 0.
+func newTestTarget(t *testing.T, status int) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if status == 0 {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+
+		rw.WriteHeader(status)
+	}))
+	t.Cleanup(s.Close)
+
+	return s
+}
+
+func TestRequestChain(t *testing.T) {
+	const (
+		targetSlow    = 0
+		targetRefused = -1
+	)
+
+	testCases := []struct {
+		name      string
+		mode      string
+		targets   []int
+		status    int
+		cancelled []bool
+	}{
+		{"sequential", "", []int{200, 503}, 200, []bool{false, false}},
+		{"sequential error", "", []int{200, targetRefused}, 500, []bool{false, false}},
+		{"parallel", "parallel", []int{200, 503, 404}, 200, []bool{false, false, false}},
+		{"parallel error", "parallel", []int{targetRefused, 200}, 500, []bool{false, false}},
+		{"race", "race", []int{targetSlow, 200}, 200, []bool{true, false}},
+		{"race error", "race", []int{targetRefused, 200}, 200, []bool{false, false}},
+		{"race failed", "race", []int{503, targetRefused}, 500, []bool{false, false}},
+		{"quorum", "quorum:2", []int{200, targetSlow, 200}, 200, []bool{false, true, false}},
+		{"quorum server errors", "quorum:2", []int{200, 503, 503}, 500, []bool{false, false, false}},
+		{"quorum error", "quorum:2", []int{200, targetRefused, 200}, 200, []bool{false, false, false}},
+		{"quorum failed", "quorum:2", []int{200, targetRefused, 500}, 500, []bool{false, false, false}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := configEndpoint{
+				Method:    "GET",
+				Route:     "/a",
+				ChainMode: tc.mode,
+			}
+
+			for _, status := range tc.targets {
+				url := "http://127.0.0.1:1/"
+				if status != targetRefused {
+					url = newTestTarget(t, status).URL + "/"
+				}
+
+				config.Chain = append(config.Chain, configEndpointTarget{Method: "GET", URL: url})
+			}
+
+			e, err := newEndpoint(&config, newTestChaos())
+			if err != nil {
+				t.Fatalf("unable to create endpoint: %s", err)
+			}
+
+			start := time.Now()
+
+			status, responses := e.requestChain(context.Background())
+			if status != tc.status {
+				t.Errorf("expected final status %d, got %d (%v)", tc.status, status, responses)
+			}
+
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("pending targets not cancelled (chain took %s)", elapsed)
+			}
+
+			for i, cancelled := range tc.cancelled {
+				if (responses[i] == "cancelled") != cancelled {
+					t.Errorf("expected target #%d cancelled to be %t, got response %q", i+1, cancelled,
+						responses[i])
+				}
+			}
+		})
+	}
+}
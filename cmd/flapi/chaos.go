@@ -0,0 +1,415 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
+)
+
+const defaultChaosBindAddr = "127.0.0.1:8666"
+
+// chaos is a Negroni middleware injecting chaotic behavior (delays, errors) into the requests it handles, according
+// to the chaos specifications set for the requests routes through a management HTTP controller.
+type chaos struct {
+	controller *chaosController
+}
+
+// newChaos returns a new chaos middleware instance with management HTTP controller listening on bindAddr (fallback
+// to defaultChaosBindAddr if empty). If bindAddr starts with "unix:", the controller will be bound to a UNIX socket
+// at the path described after the "unix:" prefix (e.g. "unix:/var/run/flapi-chaos.sock"). The controller also
+// manages the service health state and API endpoints, so that they can't be changed by the API clients.
+func newChaos(bindAddr string, service *service) (*chaos, error) {
+	var (
+		c = chaos{
+			controller: &chaosController{
+				routes:    make(map[string]*chaosSpec),
+				scenarios: make(map[string]*chaosScenario),
+			},
+		}
+		listener net.Listener
+		err      error
+	)
+
+	if bindAddr == "" {
+		bindAddr = defaultChaosBindAddr
+	}
+
+	router := mux.NewRouter()
+	router.HandleFunc("/scenarios", c.controller.listScenarios).
+		Methods("GET")
+	router.HandleFunc("/scenarios/{name}", c.controller.getScenario).
+		Methods("GET")
+	router.HandleFunc("/scenarios/{name}/start", c.controller.startScenario).
+		Methods("POST")
+	router.HandleFunc("/scenarios/{name}/stop", c.controller.stopScenario).
+		Methods("POST")
+	router.HandleFunc("/health", service.health.getState).
+		Methods("GET")
+	router.HandleFunc("/health", service.health.setState).
+		Methods("PUT")
+	router.HandleFunc("/endpoints", service.handler).
+		Methods("GET")
+	router.HandleFunc("/endpoints", service.createEndpoint).
+		Methods("POST")
+	router.HandleFunc("/endpoints", service.updateEndpoint).
+		Methods("PUT")
+	router.HandleFunc("/endpoints", service.deleteEndpoint).
+		Methods("DELETE")
+	router.Handle("/", c.controller)
+
+	c.controller.server = &http.Server{Handler: router}
+
+	if strings.HasPrefix(bindAddr, "unix:") {
+		if listener, err = net.Listen("unix", strings.TrimPrefix(bindAddr, "unix:")); err != nil {
+			return nil, fmt.Errorf("unable to bind UNIX socket: %s", err)
+		}
+	} else {
+		if listener, err = net.Listen("tcp", bindAddr); err != nil {
+			return nil, fmt.Errorf("unable to bind TCP socket: %s", err)
+		}
+	}
+
+	go c.controller.server.Serve(listener)
+
+	return &c, nil
+}
+
+// close stops the chaos management HTTP controller.
+func (c *chaos) close() {
+	c.controller.server.Close()
+}
+
+// ServeHTTP is the middleware method implementing the Negroni HTTP middleware Handler interface type.
+func (c *chaos) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	spec := c.controller.spec(r.Method, requestRoute(r))
+	if spec == nil {
+		next(rw, r)
+		return
+	}
+
+	if !c.inject(rw, r, spec) {
+		return
+	}
+
+	if fault := spec.injectFault(); fault != nil {
+		recordChaos(r.Context(), "fault", fault.kind)
+		fault.inject(rw, r, next)
+		return
+	}
+
+	next(rw, r)
+}
+
+// inject is the actual chaos injection code, it returns a boolean value false to signal the calling handler that it
+// must not continue the middleware chain if an injected error interrupted the request processing.
+func (c *chaos) inject(rw http.ResponseWriter, r *http.Request, spec *chaosSpec) (cont bool) {
+	if d, ok := spec.injectDelay(); ok {
+		recordChaos(r.Context(), "delay", d.String())
+
+		if _, fixed := spec.delay.dist.(fixedDelay); fixed {
+			rw.Header().Add("X-Chaos-Injected-Delay", fmt.Sprintf("%s (probability: %.1f)",
+				d, spec.delay.probability))
+		} else {
+			rw.Header().Add("X-Chaos-Injected-Delay", fmt.Sprintf("%s (distribution: %s, probability: %.1f)",
+				d, spec.delay.dist, spec.delay.probability))
+		}
+	}
+
+	if ok, statusCode, msg := spec.injectError(); ok {
+		recordChaos(r.Context(), "error", statusCode)
+
+		rw.Header().Add("X-Chaos-Injected-Error", fmt.Sprintf("%d (probability: %.1f)",
+			spec.err.statusCode, spec.err.probability))
+		http.Error(rw, msg, statusCode)
+		return false
+	}
+
+	return true
+}
+
+// chaosRouteSpec is a chaos specification along with the route it applies to.
+type chaosRouteSpec struct {
+	method string
+	path   string
+	spec   *chaosSpec
+}
+
+// loadSpecs replaces the chaos specifications previously loaded from the configuration file by specs, leaving the
+// ones set using the chaos management API untouched.
+func (c *chaos) loadSpecs(specs []*chaosRouteSpec) {
+	c.controller.Lock()
+	defer c.controller.Unlock()
+
+	for _, key := range c.controller.configured {
+		delete(c.controller.routes, key)
+	}
+
+	c.controller.configured = make([]string, len(specs))
+	for i, rs := range specs {
+		c.controller.routes[rs.method+rs.path] = rs.spec
+		c.controller.configured[i] = rs.method + rs.path
+		log.Debug("set chaos specification for %s %s", rs.method, rs.path)
+	}
+}
+
+// chaosRoutePath returns the path identifying the chaos specification route in the controller: inbound requests
+// routes are identified by their path prefixed with apiPrefix, whereas outbound requests routes are identified by
+// their target URL host and path.
+func chaosRoutePath(config *configChaosRoute) (string, error) {
+	switch {
+	case config.Route != "" && config.URL != "":
+		return "", fmt.Errorf("route and url are mutually exclusive")
+
+	case config.Route != "":
+		return apiPrefix + config.Route, nil
+
+	case config.URL != "":
+		u, err := url.Parse(config.URL)
+		if err != nil {
+			return "", fmt.Errorf("invalid url: %s", err)
+		}
+
+		return u.Host + u.Path, nil
+	}
+
+	return "", fmt.Errorf("either route or url must be specified")
+}
+
+// loadScenarios replaces the chaos scenarios by scenarios. The scenarios left unchanged are kept along with their
+// state, whereas the removed or changed ones are stopped if running; new and changed scenarios are started right away
+// if configured to.
+func (c *chaos) loadScenarios(scenarios []*chaosScenario) {
+	var (
+		current = make(map[string]*chaosScenario, len(scenarios))
+		halted  []*chaosScenario
+		started []*chaosScenario
+	)
+
+	c.controller.Lock()
+	for _, s := range scenarios {
+		if cur, ok := c.controller.scenarios[s.name]; ok && reflect.DeepEqual(cur.config, s.config) {
+			current[s.name] = cur
+			continue
+		}
+
+		current[s.name] = s
+		if s.config.Autostart {
+			started = append(started, s)
+		}
+	}
+
+	for name, s := range c.controller.scenarios {
+		if current[name] != s {
+			halted = append(halted, s)
+		}
+	}
+	c.controller.scenarios = current
+	c.controller.Unlock()
+
+	// The scenarios are halted outside of the controller lock, since they remove the specifications they have set
+	for _, s := range halted {
+		s.halt()
+	}
+
+	for _, s := range started {
+		s.start()
+	}
+}
+
+type chaosController struct {
+	server     *http.Server
+	routes     map[string]*chaosSpec
+	configured []string
+	scenarios  map[string]*chaosScenario
+
+	sync.RWMutex
+}
+
+func (c *chaosController) setSpec(method, path string, spec *chaosSpec) {
+	c.Lock()
+	c.routes[method+path] = spec
+	c.Unlock()
+}
+
+// replaceSpec sets the chaos specification for the route defined by method and path, removing it if spec is nil, and
+// returns the previous one if any.
+func (c *chaosController) replaceSpec(method, path string, spec *chaosSpec) *chaosSpec {
+	c.Lock()
+	defer c.Unlock()
+
+	previous := c.routes[method+path]
+	if spec != nil {
+		c.routes[method+path] = spec
+	} else {
+		delete(c.routes, method+path)
+	}
+
+	return previous
+}
+
+// delEndpointSpecs removes the chaos specifications of the endpoint e routes and chain targets.
+func (c *chaosController) delEndpointSpecs(e *endpoint) {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, route := range e.routes() {
+		delete(c.routes, route.method+route.route)
+	}
+
+	for _, t := range e.targets {
+		delete(c.routes, t.method+t.url.Host+t.url.Path)
+	}
+}
+
+// spec returns the chaos specification currently in effect for the route defined by method and path, or nil if
+// there is none.
+func (c *chaosController) spec(method, path string) *chaosSpec {
+	c.RLock()
+	spec, ok := c.routes[method+path]
+	c.RUnlock()
+
+	if !ok || (!spec.until.IsZero() && time.Now().After(spec.until)) {
+		return nil
+	}
+
+	return spec
+}
+
+func (c *chaosController) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	var (
+		method string
+		path   string
+	)
+
+	// Outbound requests chaos specifications are identified by the requests target host in addition to their
+	// method and path.
+	host := r.URL.Query().Get("host")
+
+	if method = r.URL.Query().Get("method"); method == "" {
+		http.Error(rw, "Missing value for method parameter", http.StatusBadRequest)
+		return
+	}
+
+	if path = r.URL.Query().Get("path"); path == "" {
+		http.Error(rw, "Missing value for path parameter", http.StatusBadRequest)
+		return
+	}
+	path = host + path
+
+	switch r.Method {
+	case "GET":
+		c.getRouteChaosSpec(rw, r, method, path)
+
+	case "PUT":
+		c.setRouteChaosSpec(rw, r, method, path)
+
+	case "DELETE":
+		c.delRouteChaosSpec(rw, r, method, path)
+
+	default:
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (c *chaosController) setRouteChaosSpec(rw http.ResponseWriter, r *http.Request, method, path string) {
+	var cs chaosSpec
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(data, &cs); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	c.setSpec(method, path, &cs)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (c *chaosController) getRouteChaosSpec(rw http.ResponseWriter, r *http.Request, method, path string) {
+	c.RLock()
+	spec, ok := c.routes[method+path]
+	c.RUnlock()
+	if !ok {
+		http.Error(rw, "No such route", http.StatusNotFound)
+		return
+	}
+
+	if spec.delay != nil {
+		fmt.Fprintf(rw, "Delay: %s (probability: %.1f)\n", spec.delay.dist, spec.delay.probability)
+	}
+
+	if spec.err != nil {
+		fmt.Fprintf(rw, "Error: %d %q (probability: %.1f)\n",
+			spec.err.statusCode, spec.err.message, spec.err.probability)
+	}
+
+	if spec.fault != nil {
+		fmt.Fprintf(rw, "Fault: %s (probability: %.1f)\n", spec.fault, spec.fault.probability)
+	}
+
+	if !spec.until.IsZero() {
+		fmt.Fprintf(rw, "Until: %s\n", spec.until)
+	}
+}
+
+func (c *chaosController) delRouteChaosSpec(rw http.ResponseWriter, r *http.Request, method, path string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if _, ok := c.routes[method+path]; !ok {
+		http.Error(rw, "No such route", http.StatusNotFound)
+		return
+	}
+
+	delete(c.routes, method+path)
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// recordChaos records a chaos injection as an annotation of the current trace span of ctx, in the chaos injections
+// metrics and in the access log entry of the request. Injections into outbound requests are recorded along with their target.
+func recordChaos(ctx context.Context, injection string, value interface{}) {
+	var attribute trace.Attribute
+
+	key := "chaos." + injection
+	if n, ok := value.(int); ok {
+		attribute = trace.Int64Attribute{Key: key, Value: int64(n)}
+	} else {
+		attribute = trace.StringAttribute{Key: key, Value: fmt.Sprint(value)}
+	}
+
+	trace.FromContext(ctx).Annotate([]trace.Attribute{attribute}, "chaos: injected "+injection)
+
+	if mw, ok := ctx.Value(metricsContextKey).(*metricsMiddleware); ok {
+		if target, ok := ctx.Value(chaosTargetContextKey).(string); ok {
+			mw.recordChaos(ctx, injection, "outbound", target)
+		} else {
+			mw.recordChaos(ctx, injection, "inbound", routeTag(ctx))
+		}
+	}
+
+	if entry, ok := ctx.Value(accessLogContextKey).(*accessLogEntry); ok {
+		chaos := fmt.Sprintf("%s=%v", injection, value)
+		if target, ok := ctx.Value(chaosTargetContextKey).(string); ok {
+			chaos = target + " " + chaos
+		}
+
+		entry.addChaos(chaos)
+	}
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	distributionFixed       = "fixed"
+	distributionUniform     = "uniform"
+	distributionNormal      = "normal"
+	distributionLogNormal   = "lognormal"
+	distributionExponential = "exponential"
+	distributionPercentiles = "percentiles"
+)
+
+// delayParams represents the parameters of a delay distribution, the relevant ones depending on the distribution.
+type delayParams struct {
+	duration    time.Duration
+	min         time.Duration
+	max         time.Duration
+	mean        time.Duration
+	stddev      time.Duration
+	percentiles map[string]time.Duration
+}
+
+// delayDistribution is the interface implemented by the chaos delay distributions.
+type delayDistribution interface {
+	sample() time.Duration
+	String() string
+}
+
+func newDelayDistribution(kind string, params *delayParams) (delayDistribution, error) {
+	switch kind {
+	case "", distributionFixed:
+		if params.duration <= 0 {
+			return nil, fmt.Errorf("delay duration parameter value must be greater than 0")
+		}
+
+		return fixedDelay(params.duration), nil
+
+	case distributionUniform:
+		if params.min < 0 || params.max <= params.min {
+			return nil, fmt.Errorf("uniform distribution requires 0 <= min < max")
+		}
+
+		return &uniformDelay{min: params.min, max: params.max}, nil
+
+	case distributionNormal:
+		if params.mean <= 0 || params.stddev < 0 {
+			return nil, fmt.Errorf("normal distribution requires mean > 0 and stddev >= 0")
+		}
+
+		return &normalDelay{mean: params.mean, stddev: params.stddev}, nil
+
+	case distributionLogNormal:
+		if params.mean <= 0 || params.stddev < 0 {
+			return nil, fmt.Errorf("log-normal distribution requires mean > 0 and stddev >= 0")
+		}
+
+		return newLogNormalDelay(params.mean, params.stddev), nil
+
+	case distributionExponential:
+		if params.mean <= 0 {
+			return nil, fmt.Errorf("exponential distribution requires mean > 0")
+		}
+
+		return exponentialDelay(params.mean), nil
+
+	case distributionPercentiles:
+		return newPercentilesDelay(params.percentiles)
+	}
+
+	return nil, fmt.Errorf("unsupported delay distribution %q", kind)
+}
+
+type fixedDelay time.Duration
+
+func (d fixedDelay) sample() time.Duration {
+	return time.Duration(d)
+}
+
+func (d fixedDelay) String() string {
+	return time.Duration(d).String()
+}
+
+type uniformDelay struct {
+	min time.Duration
+	max time.Duration
+}
+
+func (d *uniformDelay) sample() time.Duration {
+	return d.min + time.Duration(rand.Int63n(int64(d.max-d.min)))
+}
+
+func (d *uniformDelay) String() string {
+	return fmt.Sprintf("uniform(min=%s, max=%s)", d.min, d.max)
+}
+
+type normalDelay struct {
+	mean   time.Duration
+	stddev time.Duration
+}
+
+func (d *normalDelay) sample() time.Duration {
+	return nonNegative(rand.NormFloat64()*float64(d.stddev) + float64(d.mean))
+}
+
+func (d *normalDelay) String() string {
+	return fmt.Sprintf("normal(mean=%s, stddev=%s)", d.mean, d.stddev)
+}
+
+// logNormalDelay is a log-normal distribution parametrized by the mean and standard deviation of the resulting
+// delays, from which the underlying normal distribution parameters are computed.
+type logNormalDelay struct {
+	mean   time.Duration
+	stddev time.Duration
+	mu     float64
+	sigma  float64
+}
+
+func newLogNormalDelay(mean, stddev time.Duration) *logNormalDelay {
+	variance := math.Log(1 + math.Pow(float64(stddev)/float64(mean), 2))
+
+	return &logNormalDelay{
+		mean:   mean,
+		stddev: stddev,
+		mu:     math.Log(float64(mean)) - variance/2,
+		sigma:  math.Sqrt(variance),
+	}
+}
+
+func (d *logNormalDelay) sample() time.Duration {
+	return nonNegative(math.Exp(d.mu + d.sigma*rand.NormFloat64()))
+}
+
+func (d *logNormalDelay) String() string {
+	return fmt.Sprintf("lognormal(mean=%s, stddev=%s)", d.mean, d.stddev)
+}
+
+type exponentialDelay time.Duration
+
+func (d exponentialDelay) sample() time.Duration {
+	return nonNegative(rand.ExpFloat64() * float64(d))
+}
+
+func (d exponentialDelay) String() string {
+	return fmt.Sprintf("exponential(mean=%s)", time.Duration(d))
+}
+
+// percentilesDelay is an empirical distribution described by a percentiles table (e.g. p50, p90, p99, p999),
+// sampled by linear interpolation between the table points.
+type percentilesDelay struct {
+	names     []string
+	quantiles []float64
+	values    []time.Duration
+}
+
+func newPercentilesDelay(percentiles map[string]time.Duration) (*percentilesDelay, error) {
+	if len(percentiles) == 0 {
+		return nil, fmt.Errorf("percentiles distribution requires at least one percentile")
+	}
+
+	d := percentilesDelay{
+		quantiles: []float64{0},
+		values:    []time.Duration{0},
+	}
+
+	keys := make([]string, 0, len(percentiles))
+	for k := range percentiles {
+		keys = append(keys, k)
+	}
+
+	quantiles := make(map[string]float64)
+	for _, k := range keys {
+		q, err := parsePercentile(k)
+		if err != nil {
+			return nil, err
+		}
+		quantiles[k] = q
+	}
+
+	sort.Slice(keys, func(i, j int) bool { return quantiles[keys[i]] < quantiles[keys[j]] })
+
+	for i, k := range keys {
+		if i > 0 && quantiles[k] == quantiles[keys[i-1]] {
+			return nil, fmt.Errorf("percentiles %q and %q are identical", keys[i-1], k)
+		}
+
+		if percentiles[k] < d.values[len(d.values)-1] {
+			return nil, fmt.Errorf("percentiles values must be increasing")
+		}
+
+		d.names = append(d.names, k)
+		d.quantiles = append(d.quantiles, quantiles[k])
+		d.values = append(d.values, percentiles[k])
+	}
+
+	return &d, nil
+}
+
+// parsePercentile returns the quantile corresponding to a percentile name, e.g. "p05" => 0.05, "p50" => 0.5,
+// "p999" => 0.999. Single-digit names are ambiguous (e.g. "p5" could be read as either 0.05 or 0.5) and rejected.
+func parsePercentile(name string) (float64, error) {
+	digits := strings.TrimPrefix(name, "p")
+	if digits == name || digits == "" {
+		return 0, fmt.Errorf("invalid percentile %q", name)
+	}
+
+	if len(digits) < 2 {
+		return 0, fmt.Errorf("invalid percentile %q: at least two digits are required (e.g. p05)", name)
+	}
+
+	if _, err := strconv.ParseUint(digits, 10, 64); err != nil {
+		return 0, fmt.Errorf("invalid percentile %q", name)
+	}
+
+	if digits == "100" {
+		return 1, nil
+	}
+
+	q, _ := strconv.ParseFloat("0."+digits, 64)
+	if q == 0 {
+		return 0, fmt.Errorf("invalid percentile %q", name)
+	}
+
+	return q, nil
+}
+
+func (d *percentilesDelay) sample() time.Duration {
+	u := rand.Float64()
+
+	for i := 1; i < len(d.quantiles); i++ {
+		if u <= d.quantiles[i] {
+			ratio := (u - d.quantiles[i-1]) / (d.quantiles[i] - d.quantiles[i-1])
+			return d.values[i-1] + time.Duration(ratio*float64(d.values[i]-d.values[i-1]))
+		}
+	}
+
+	// Samples above the highest percentile are capped to its value
+	return d.values[len(d.values)-1]
+}
+
+func (d *percentilesDelay) String() string {
+	points := make([]string, len(d.names))
+	for i, name := range d.names {
+		points[i] = fmt.Sprintf("%s=%s", name, d.values[i+1])
+	}
+
+	return fmt.Sprintf("percentiles(%s)", strings.Join(points, ", "))
+}
+
+func nonNegative(v float64) time.Duration {
+	if v < 0 {
+		return 0
+	}
+
+	return time.Duration(v)
+}
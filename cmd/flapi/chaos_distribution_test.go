@@ -0,0 +1,52 @@
+package main
+
+import "testing"
+
+func TestParsePercentile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		quantile float64
+		err      bool
+	}{
+		{"p01", 0.01, false},
+		{"p05", 0.05, false},
+		{"p10", 0.1, false},
+		{"p50", 0.5, false},
+		{"p99", 0.99, false},
+		{"p999", 0.999, false},
+		{"p9999", 0.9999, false},
+		{"p100", 1, false},
+		{"", 0, true},
+		{"p", 0, true},
+		{"50", 0, true},
+		{"P50", 0, true},
+		{"p5", 0, true},
+		{"p00", 0, true},
+		{"p000", 0, true},
+		{"p5a", 0, true},
+		{"p-5", 0, true},
+		{"p+50", 0, true},
+		{"p 50", 0, true},
+		{"p5.5", 0, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := parsePercentile(tc.name)
+			if tc.err {
+				if err == nil {
+					t.Errorf("expected error, got quantile %g", q)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if q != tc.quantile {
+				t.Errorf("expected quantile %g, got %g", tc.quantile, q)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	faultAbort         = "abort"
+	faultReset         = "reset"
+	faultHang          = "hang"
+	faultTruncate      = "truncate"
+	faultContentLength = "content_length"
+	faultSlowBody      = "slow_body"
+
+	// Number of extra bytes announced by the content_length fault in the response Content-Length header
+	faultContentLengthExtra = 1024
+
+	faultSlowBodyInterval = 100 * time.Millisecond
+)
+
+type chaosFaultSpec struct {
+	kind        string
+	rate        int
+	probability float64
+}
+
+func (s *chaosFaultSpec) UnmarshalJSON(data []byte) error {
+	faultSpec := struct {
+		Type        string  `json:"type"`
+		Rate        int     `json:"rate"`
+		Probability float64 `json:"p"`
+	}{}
+
+	if err := json.Unmarshal(data, &faultSpec); err != nil {
+		return err
+	}
+
+	s.kind = faultSpec.Type
+	s.rate = faultSpec.Rate
+	s.probability = faultSpec.Probability
+	if s.probability == 0 {
+		s.probability = 1
+	}
+
+	return s.validate()
+}
+
+func (s *chaosFaultSpec) validate() error {
+	switch s.kind {
+	case faultAbort, faultReset, faultHang, faultTruncate, faultContentLength:
+	case faultSlowBody:
+		if s.rate <= 0 {
+			return fmt.Errorf("slow body fault rate parameter value must be greater than 0")
+		}
+	default:
+		return fmt.Errorf("unsupported fault type %q", s.kind)
+	}
+
+	if s.probability < 0 || s.probability > 1 {
+		return fmt.Errorf("probability parameter value must be 0 <= p <= 1")
+	}
+
+	return nil
+}
+
+func (s *chaosFaultSpec) String() string {
+	if s.kind == faultSlowBody {
+		return fmt.Sprintf("%s (%d B/s)", s.kind, s.rate)
+	}
+
+	return s.kind
+}
+
+// injectFault returns the fault specification if a fault has to be injected according to its probability, or nil
+// otherwise.
+func (s *chaosSpec) injectFault() *chaosFaultSpec {
+	if s.fault != nil {
+		if p := rand.Float64(); p > 1-s.fault.probability {
+			return s.fault
+		}
+	}
+
+	return nil
+}
+
+// inject disrupts the request processing at the network level according to the fault type. Depending on the type,
+// the next handler might not be executed at all (e.g. abort, hang), or have its response altered.
+func (s *chaosFaultSpec) inject(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var err error
+
+	switch s.kind {
+	case faultAbort, faultReset:
+		err = abortConnection(rw, s.kind == faultReset)
+
+	case faultHang:
+		<-r.Context().Done()
+
+	case faultTruncate, faultContentLength, faultSlowBody:
+		rec := &bufferResponseWriter{header: http.Header{}}
+		next(rec, r)
+
+		for k, v := range rec.header {
+			rw.Header()[k] = v
+		}
+		rw.Header().Add("X-Chaos-Injected-Fault", fmt.Sprintf("%s (probability: %.1f)", s, s.probability))
+
+		body := rec.body.Bytes()
+
+		switch s.kind {
+		case faultTruncate:
+			err = writeRawResponse(rw, rec.statusCode(), len(body), body[:len(body)/2])
+
+		case faultContentLength:
+			err = writeRawResponse(rw, rec.statusCode(), len(body)+faultContentLengthExtra, body)
+
+		case faultSlowBody:
+			err = dripResponse(rw, r, rec.statusCode(), body, s.rate)
+		}
+	}
+
+	if err != nil {
+		log.Error("unable to inject %s fault: %s", s.kind, err)
+	}
+}
+
+// abortConnection closes the underlying client connection without sending any response. If reset is true, the
+// connection is closed with a TCP RST instead of a regular FIN. If the connection can't be hijacked (e.g. HTTP/2),
+// the request handling is aborted instead, resulting in the client stream being reset.
+func abortConnection(rw http.ResponseWriter, reset bool) error {
+	conn, _, err := hijack(rw)
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok && reset {
+		tcpConn.SetLinger(0)
+	}
+
+	return conn.Close()
+}
+
+// writeRawResponse writes directly to the client connection a response announcing contentLength bytes of body but
+// actually sending body, then closes the connection. If the connection can't be hijacked (e.g. HTTP/2), the response
+// is written and flushed before the request handling is aborted, resulting in the client stream being reset.
+func writeRawResponse(rw http.ResponseWriter, status, contentLength int, body []byte) error {
+	header := rw.Header()
+	if header.Get("Content-Type") == "" && len(body) > 0 {
+		header.Set("Content-Type", http.DetectContentType(body))
+	}
+	header.Set("Content-Length", strconv.Itoa(contentLength))
+	header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	conn, buf, err := hijack(rw)
+	if err != nil {
+		rw.WriteHeader(status)
+		rw.Write(body)
+		if flusher, ok := rw.(http.Flusher); ok {
+			flusher.Flush()
+		}
+
+		panic(http.ErrAbortHandler)
+	}
+	defer conn.Close()
+
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	buf.Write(body)
+
+	return buf.Flush()
+}
+
+// hijack takes over the client connection of rw.
+func hijack(rw http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := rw.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("connection hijacking not supported")
+	}
+
+	return hj.Hijack()
+}
+
+// dripResponse writes the response body to the client at rate bytes per second.
+func dripResponse(rw http.ResponseWriter, r *http.Request, status int, body []byte, rate int) error {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		return fmt.Errorf("response flushing not supported")
+	}
+
+	chunk := rate * int(faultSlowBodyInterval) / int(time.Second)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	rw.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	rw.WriteHeader(status)
+	flusher.Flush()
+
+	for len(body) > 0 {
+		n := chunk
+		if n > len(body) {
+			n = len(body)
+		}
+
+		if _, err := rw.Write(body[:n]); err != nil {
+			return err
+		}
+		flusher.Flush()
+		body = body[n:]
+
+		if len(body) > 0 {
+			select {
+			case <-time.After(time.Duration(n) * time.Second / time.Duration(rate)):
+			case <-r.Context().Done():
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
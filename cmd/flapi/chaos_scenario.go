@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/facette/httputil"
+	"github.com/gorilla/mux"
+)
+
+const (
+	scenarioIdle      = "idle"
+	scenarioRunning   = "running"
+	scenarioCompleted = "completed"
+	scenarioStopped   = "stopped"
+)
+
+type chaosScenarioStep struct {
+	at     time.Duration
+	method string
+	path   string
+	clear  bool
+	config *configChaosSpec
+}
+
+// chaosScenario is a timeline of chaos specifications changes, executed by a scheduler goroutine once started.
+type chaosScenario struct {
+	name       string
+	config     *configChaosScenario
+	steps      []*chaosScenarioStep
+	controller *chaosController
+
+	state    string
+	started  time.Time
+	executed int
+	stop     chan struct{}
+	done     chan struct{}
+
+	// saved are the chaos specifications in effect for the routes changed by the executed steps before the scenario
+	// changed them (nil if there was none), restored if the scenario is stopped.
+	saved []*chaosRouteSpec
+
+	sync.Mutex
+}
+
+func newChaosScenario(config *configChaosScenario, controller *chaosController) (*chaosScenario, error) {
+	s := chaosScenario{
+		name:       config.Name,
+		config:     config,
+		controller: controller,
+		state:      scenarioIdle,
+	}
+
+	if s.name == "" {
+		return nil, fmt.Errorf("name not specified")
+	}
+
+	if len(config.Steps) == 0 {
+		return nil, fmt.Errorf("no steps specified")
+	}
+
+	s.steps = make([]*chaosScenarioStep, len(config.Steps))
+	for i, step := range config.Steps {
+		if step.Method == "" {
+			return nil, fmt.Errorf("step #%d: method not specified", i+1)
+		}
+
+		path, err := chaosRoutePath(&step.configChaosRoute)
+		if err != nil {
+			return nil, fmt.Errorf("step #%d: %s", i+1, err)
+		}
+
+		if step.At < 0 {
+			return nil, fmt.Errorf("step #%d: time offset must be positive", i+1)
+		}
+
+		if !step.Clear {
+			if step.Delay == nil && step.Error == nil && step.Fault == nil {
+				return nil, fmt.Errorf("step #%d: either delay, error, fault or clear must be specified", i+1)
+			}
+
+			// Validate the step chaos specification now, although the actual specification will only be created
+			// when executing the step since its enforcement duration is relative to that time.
+			if _, err := newChaosSpec(&step.configChaosSpec); err != nil {
+				return nil, fmt.Errorf("step #%d: %s", i+1, err)
+			}
+		}
+
+		s.steps[i] = &chaosScenarioStep{
+			at:     step.At,
+			method: step.Method,
+			path:   path,
+			clear:  step.Clear,
+			config: &config.Steps[i].configChaosSpec,
+		}
+	}
+
+	sort.SliceStable(s.steps, func(i, j int) bool { return s.steps[i].at < s.steps[j].at })
+
+	return &s, nil
+}
+
+// start starts the scenario scheduler, returning an error if the scenario is already running.
+func (s *chaosScenario) start() error {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.state == scenarioRunning {
+		return fmt.Errorf("scenario already running")
+	}
+
+	s.state = scenarioRunning
+	s.started = time.Now()
+	s.executed = 0
+	s.saved = nil
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+
+	log.Info("starting chaos scenario %q", s.name)
+
+	go s.run(s.started, s.stop, s.done)
+
+	return nil
+}
+
+// halt stops the scenario scheduler and restores the chaos specifications changed by the executed steps, returning an
+// error if the scenario is not running.
+func (s *chaosScenario) halt() error {
+	s.Lock()
+	if s.state != scenarioRunning {
+		s.Unlock()
+		return fmt.Errorf("scenario not running")
+	}
+	close(s.stop)
+	done := s.done
+	s.Unlock()
+
+	<-done
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, rs := range s.saved {
+		s.controller.replaceSpec(rs.method, rs.path, rs.spec)
+	}
+	s.state = scenarioStopped
+
+	log.Info("stopped chaos scenario %q", s.name)
+
+	return nil
+}
+
+func (s *chaosScenario) run(started time.Time, stop, done chan struct{}) {
+	defer close(done)
+
+	for i, step := range s.steps {
+		timer := time.NewTimer(time.Until(started.Add(step.at)))
+
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+
+		case <-timer.C:
+		}
+
+		var spec *chaosSpec
+
+		if step.clear {
+			log.Debug("chaos scenario %q: cleared chaos specification for %s %s", s.name, step.method, step.path)
+		} else {
+			// Specification validity has been checked at scenario creation
+			spec, _ = newChaosSpec(step.config)
+			log.Debug("chaos scenario %q: set chaos specification for %s %s", s.name, step.method, step.path)
+		}
+
+		previous := s.controller.replaceSpec(step.method, step.path, spec)
+
+		s.Lock()
+		s.executed = i + 1
+		s.save(step.method, step.path, previous)
+		s.Unlock()
+	}
+
+	s.Lock()
+	s.state = scenarioCompleted
+	s.Unlock()
+
+	log.Info("chaos scenario %q completed", s.name)
+}
+
+// save records the chaos specification in effect for a route before the scenario first changed it. The caller must
+// hold the scenario lock.
+func (s *chaosScenario) save(method, path string, spec *chaosSpec) {
+	for _, rs := range s.saved {
+		if rs.method == method && rs.path == path {
+			return
+		}
+	}
+
+	s.saved = append(s.saved, &chaosRouteSpec{method: method, path: path, spec: spec})
+}
+
+func (s *chaosScenario) MarshalJSON() ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	js := map[string]interface{}{
+		"name":     s.name,
+		"state":    s.state,
+		"steps":    len(s.steps),
+		"executed": s.executed,
+	}
+
+	if !s.started.IsZero() {
+		js["started"] = s.started
+	}
+
+	if s.state == scenarioRunning {
+		js["elapsed"] = time.Since(s.started).String()
+		if s.executed < len(s.steps) {
+			js["next_step_in"] = time.Until(s.started.Add(s.steps[s.executed].at)).String()
+		}
+	}
+
+	return json.Marshal(js)
+}
+
+func (c *chaosController) listScenarios(rw http.ResponseWriter, r *http.Request) {
+	c.RLock()
+	scenarios := make([]*chaosScenario, 0, len(c.scenarios))
+	for _, s := range c.scenarios {
+		scenarios = append(scenarios, s)
+	}
+	c.RUnlock()
+
+	sort.Slice(scenarios, func(i, j int) bool { return scenarios[i].name < scenarios[j].name })
+
+	httputil.WriteJSON(rw, scenarios, http.StatusOK)
+}
+
+func (c *chaosController) scenario(rw http.ResponseWriter, r *http.Request) *chaosScenario {
+	c.RLock()
+	s, ok := c.scenarios[mux.Vars(r)["name"]]
+	c.RUnlock()
+	if !ok {
+		http.Error(rw, "No such scenario", http.StatusNotFound)
+		return nil
+	}
+
+	return s
+}
+
+func (c *chaosController) getScenario(rw http.ResponseWriter, r *http.Request) {
+	if s := c.scenario(rw, r); s != nil {
+		httputil.WriteJSON(rw, s, http.StatusOK)
+	}
+}
+
+func (c *chaosController) startScenario(rw http.ResponseWriter, r *http.Request) {
+	if s := c.scenario(rw, r); s != nil {
+		if err := s.start(); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func (c *chaosController) stopScenario(rw http.ResponseWriter, r *http.Request) {
+	if s := c.scenario(rw, r); s != nil {
+		if err := s.halt(); err != nil {
+			http.Error(rw, err.Error(), http.StatusConflict)
+			return
+		}
+
+		rw.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+type chaosSpec struct {
+	delay *chaosDelaySpec
+	err   *chaosErrorSpec
+	fault *chaosFaultSpec
+
+	until time.Time
+}
+
+// newChaosSpec returns a chaos specification from its configuration file definition.
+func newChaosSpec(config *configChaosSpec) (*chaosSpec, error) {
+	var s chaosSpec
+
+	if config.Delay != nil {
+		dist, err := newDelayDistribution(config.Delay.Distribution, &delayParams{
+			duration:    config.Delay.Duration,
+			min:         config.Delay.Min,
+			max:         config.Delay.Max,
+			mean:        config.Delay.Mean,
+			stddev:      config.Delay.StdDev,
+			percentiles: config.Delay.Percentiles,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		s.delay = &chaosDelaySpec{
+			dist:        dist,
+			probability: config.Delay.Probability,
+		}
+
+		if s.delay.probability == 0 {
+			s.delay.probability = 1
+		}
+
+		if err := s.delay.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Error != nil {
+		s.err = &chaosErrorSpec{
+			statusCode:  config.Error.StatusCode,
+			message:     config.Error.Message,
+			probability: config.Error.Probability,
+		}
+
+		if s.err.probability == 0 {
+			s.err.probability = 1
+		}
+
+		if err := s.err.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Fault != nil {
+		s.fault = &chaosFaultSpec{
+			kind:        config.Fault.Type,
+			rate:        config.Fault.Rate,
+			probability: config.Fault.Probability,
+		}
+
+		if s.fault.probability == 0 {
+			s.fault.probability = 1
+		}
+
+		if err := s.fault.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if config.Duration < 0 {
+		return nil, fmt.Errorf("duration must be positive")
+	} else if config.Duration > 0 {
+		s.until = time.Now().Add(config.Duration)
+	}
+
+	return &s, nil
+}
+
+func (s *chaosSpec) UnmarshalJSON(data []byte) error {
+	chaosSpec := struct {
+		Delay    *chaosDelaySpec `json:"delay,omitempty"`
+		Error    *chaosErrorSpec `json:"error,omitempty"`
+		Fault    *chaosFaultSpec `json:"fault,omitempty"`
+		Duration string          `json:"duration,omitempty"`
+	}{}
+
+	if err := json.Unmarshal(data, &chaosSpec); err != nil {
+		return err
+	}
+
+	s.delay = chaosSpec.Delay
+	s.err = chaosSpec.Error
+	s.fault = chaosSpec.Fault
+
+	if chaosSpec.Duration != "" {
+		duration, err := time.ParseDuration(chaosSpec.Duration)
+		if err != nil {
+			return fmt.Errorf("invalid value for duration parameter: %s", err)
+		}
+
+		s.until = time.Now().Add(duration)
+	}
+
+	return nil
+}
+
+type chaosDelaySpec struct {
+	dist        delayDistribution
+	probability float64
+}
+
+func (s *chaosDelaySpec) UnmarshalJSON(data []byte) error {
+	delaySpec := struct {
+		Distribution string         `json:"distribution"`
+		Duration     int            `json:"duration"`
+		Min          int            `json:"min"`
+		Max          int            `json:"max"`
+		Mean         int            `json:"mean"`
+		StdDev       int            `json:"stddev"`
+		Percentiles  map[string]int `json:"percentiles"`
+		Probability  float64        `json:"p"`
+	}{}
+
+	if err := json.Unmarshal(data, &delaySpec); err != nil {
+		return err
+	}
+
+	params := delayParams{
+		duration:    time.Duration(delaySpec.Duration) * time.Millisecond,
+		min:         time.Duration(delaySpec.Min) * time.Millisecond,
+		max:         time.Duration(delaySpec.Max) * time.Millisecond,
+		mean:        time.Duration(delaySpec.Mean) * time.Millisecond,
+		stddev:      time.Duration(delaySpec.StdDev) * time.Millisecond,
+		percentiles: make(map[string]time.Duration),
+	}
+	for k, v := range delaySpec.Percentiles {
+		params.percentiles[k] = time.Duration(v) * time.Millisecond
+	}
+
+	dist, err := newDelayDistribution(delaySpec.Distribution, &params)
+	if err != nil {
+		return err
+	}
+
+	s.dist = dist
+	s.probability = delaySpec.Probability
+	if s.probability == 0 {
+		s.probability = 1
+	}
+
+	return s.validate()
+}
+
+func (s *chaosDelaySpec) validate() error {
+	if s.probability < 0 || s.probability > 1 {
+		return fmt.Errorf("probability parameter value must be 0 <= p <= 1")
+	}
+
+	return nil
+}
+
+// sampleDelay returns a delay sampled from the delay specification distribution if a delay has to be injected
+// according to its probability.
+func (s *chaosSpec) sampleDelay() (time.Duration, bool) {
+	if s.delay != nil {
+		if p := rand.Float64(); p > 1-s.delay.probability {
+			return s.delay.dist.sample(), true
+		}
+	}
+
+	return 0, false
+}
+
+// injectDelay sleeps for a delay sampled from the delay specification distribution according to its probability,
+// and returns the injected delay duration.
+func (s *chaosSpec) injectDelay() (time.Duration, bool) {
+	d, ok := s.sampleDelay()
+	if ok {
+		time.Sleep(d)
+	}
+
+	return d, ok
+}
+
+type chaosErrorSpec struct {
+	statusCode  int
+	message     string
+	probability float64
+}
+
+func (s *chaosErrorSpec) UnmarshalJSON(data []byte) error {
+	spec := struct {
+		StatusCode  int     `json:"status_code"`
+		Message     string  `json:"message"`
+		Probability float64 `json:"p"`
+	}{}
+
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return err
+	}
+
+	s.statusCode = spec.StatusCode
+	s.message = spec.Message
+	s.probability = spec.Probability
+	if s.probability == 0 {
+		s.probability = 1
+	}
+
+	return s.validate()
+}
+
+func (s *chaosErrorSpec) validate() error {
+	if s.statusCode < 100 || s.statusCode > 600 {
+		return fmt.Errorf("error status code parameter value must be 100 < p < 600")
+	}
+
+	if s.probability < 0 || s.probability > 1 {
+		return fmt.Errorf("probability parameter value must be 0 <= p <= 1")
+	}
+
+	return nil
+}
+
+func (s *chaosSpec) injectError() (bool, int, string) {
+	if s.err != nil {
+		if p := rand.Float64(); p > 1-s.err.probability {
+			return true, s.err.statusCode, s.err.message
+		}
+	}
+
+	return false, 0, ""
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// chaosTransport is a http.RoundTripper injecting chaos into outbound requests, according to the chaos specifications
+// set for the requests target method, host and path.
+type chaosTransport struct {
+	controller *chaosController
+	next       http.RoundTripper
+}
+
+// transport returns a chaos-aware http.RoundTripper performing the actual requests using next.
+func (c *chaos) transport(next http.RoundTripper) http.RoundTripper {
+	return &chaosTransport{controller: c.controller, next: next}
+}
+
+func (t *chaosTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	path := req.URL.Host + req.URL.Path
+	if target, ok := req.Context().Value(chaosTargetContextKey).(string); ok {
+		path = target
+	}
+
+	spec := t.controller.spec(req.Method, path)
+	if spec == nil {
+		return t.next.RoundTrip(req)
+	}
+
+	if d, ok := spec.sampleDelay(); ok {
+		log.Debug("injecting %s delay into outbound request %s %s", d, req.Method, req.URL)
+		recordChaos(req.Context(), "delay", d.String())
+
+		select {
+		case <-time.After(d):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+
+	if ok, statusCode, msg := spec.injectError(); ok {
+		log.Debug("injecting %d error into outbound request %s %s", statusCode, req.Method, req.URL)
+		recordChaos(req.Context(), "error", statusCode)
+		return errorResponse(req, statusCode, msg), nil
+	}
+
+	if fault := spec.injectFault(); fault != nil {
+		log.Debug("injecting %s fault into outbound request %s %s", fault.kind, req.Method, req.URL)
+		recordChaos(req.Context(), "fault", fault.kind)
+		return t.injectFault(req, fault)
+	}
+
+	return t.next.RoundTrip(req)
+}
+
+func (t *chaosTransport) injectFault(req *http.Request, fault *chaosFaultSpec) (*http.Response, error) {
+	switch fault.kind {
+	case faultAbort:
+		return nil, fmt.Errorf("injected fault: %s", io.ErrUnexpectedEOF)
+
+	case faultReset:
+		return nil, fmt.Errorf("injected fault: %s", syscall.ECONNRESET)
+
+	case faultHang:
+		<-req.Context().Done()
+		return nil, req.Context().Err()
+	}
+
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	switch fault.kind {
+	case faultTruncate:
+		res.Body = &faultyBody{Reader: bytes.NewReader(data[:len(data)/2])}
+
+	case faultContentLength:
+		res.ContentLength = int64(len(data) + faultContentLengthExtra)
+		res.Header.Set("Content-Length", strconv.FormatInt(res.ContentLength, 10))
+		res.Body = &faultyBody{Reader: bytes.NewReader(data)}
+
+	case faultSlowBody:
+		res.Body = &slowBody{ctx: req.Context(), data: data, rate: fault.rate}
+	}
+
+	return res, nil
+}
+
+func errorResponse(req *http.Request, statusCode int, msg string) *http.Response {
+	body := msg + "\n"
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", statusCode, http.StatusText(statusCode)),
+		StatusCode:    statusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": []string{"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(bytes.NewBufferString(body)),
+		ContentLength: int64(len(body)),
+		Request:       req,
+	}
+}
+
+// faultyBody is a response body returning an unexpected EOF error once its content has been read.
+type faultyBody struct {
+	io.Reader
+}
+
+func (b *faultyBody) Read(p []byte) (int, error) {
+	n, err := b.Reader.Read(p)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (b *faultyBody) Close() error {
+	return nil
+}
+
+// slowBody is a response body returning its content at rate bytes per second.
+type slowBody struct {
+	ctx     context.Context
+	data    []byte
+	rate    int
+	started bool
+}
+
+func (b *slowBody) Read(p []byte) (int, error) {
+	if len(b.data) == 0 {
+		return 0, io.EOF
+	}
+
+	chunk := b.rate * int(faultSlowBodyInterval) / int(time.Second)
+	if chunk < 1 {
+		chunk = 1
+	}
+
+	n := chunk
+	if n > len(p) {
+		n = len(p)
+	}
+	if n > len(b.data) {
+		n = len(b.data)
+	}
+
+	if b.started {
+		select {
+		case <-time.After(time.Duration(n) * time.Second / time.Duration(b.rate)):
+		case <-b.ctx.Done():
+			return 0, b.ctx.Err()
+		}
+	}
+	b.started = true
+
+	copy(p, b.data[:n])
+	b.data = b.data[n:]
+
+	return n, nil
+}
+
+func (b *slowBody) Close() error {
+	return nil
+}
@@ -1,46 +1,229 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
 var (
 	defaultMetricsLatencyHistogramBuckets = []float64{0.01, 0.05, 0.1, 0.5, 1.0, 5.0, 10.0, 30.0}
+	defaultMetricsSizeHistogramBuckets    = []float64{100, 1000, 10000, 100000, 1000000}
 )
 
 type configMetrics struct {
 	LatencyHistogramBuckets []float64 `yaml:"latency_histogram_buckets"`
+	SizeHistogramBuckets    []float64 `yaml:"size_histogram_buckets"`
+	Tags                    []string  `yaml:"tags"`
+}
+
+type configAccessLog struct {
+	Format     string `yaml:"format"`
+	Output     string `yaml:"output"`
+	MaxSize    int    `yaml:"max_size"`
+	MaxBackups int    `yaml:"max_backups"`
+}
+
+type configServerTLS struct {
+	CertFile           string        `yaml:"cert_file"`
+	KeyFile            string        `yaml:"key_file"`
+	SelfSigned         bool          `yaml:"self_signed"`
+	SelfSignedValidity time.Duration `yaml:"self_signed_validity"`
+	ClientCAFile       string        `yaml:"client_ca_file"`
+	ClientAuth         string        `yaml:"client_auth"`
+}
+
+type configServer struct {
+	TLS *configServerTLS `yaml:"tls"`
+	H2C bool             `yaml:"h2c"`
+}
+
+type configShutdown struct {
+	PreStopDelay time.Duration `yaml:"pre_stop_delay"`
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	ExitDelay    time.Duration `yaml:"exit_delay"`
+}
+
+type configHealth struct {
+	Healthy        bool          `yaml:"healthy"`
+	Ready          bool          `yaml:"ready"`
+	Delay          time.Duration `yaml:"delay"`
+	CheckTargets   bool          `yaml:"check_targets"`
+	TargetsPath    string        `yaml:"targets_path"`
+	TargetsTimeout time.Duration `yaml:"targets_timeout"`
+}
+
+type configTracingExporter struct {
+	Type string `yaml:"type"`
+	URL  string `yaml:"url"`
+	Path string `yaml:"path"`
+}
+
+type configTracing struct {
+	ServiceName  string                  `yaml:"service_name"`
+	SamplingRate float64                 `yaml:"sampling_rate"`
+	Exporters    []configTracingExporter `yaml:"exporters"`
+}
+
+type configBackoff struct {
+	Type        string        `yaml:"type"`
+	Interval    time.Duration `yaml:"interval"`
+	MaxInterval time.Duration `yaml:"max_interval"`
+	Jitter      float64       `yaml:"jitter"`
+}
+
+type configCircuitBreaker struct {
+	FailureRate  float64       `yaml:"failure_rate"`
+	MinRequests  int           `yaml:"min_requests"`
+	OpenDuration time.Duration `yaml:"open_duration"`
+	OpenStatus   int           `yaml:"open_status"`
+}
+
+type configTargetTLS struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// configPropagation defines how the inbound request context is propagated to the chain targets requests.
+type configPropagation struct {
+	ForwardHeaders []string          `yaml:"forward_headers"`
+	RequestHeaders map[string]string `yaml:"request_headers"`
+	ForwardBody    bool              `yaml:"forward_body"`
 }
 
 type configEndpointTarget struct {
-	Method string `yaml:"method"`
-	URL    string `yaml:"url"`
+	Method  string        `yaml:"method"`
+	URL     string        `yaml:"url"`
+	Service string        `yaml:"service"`
+	Path    string        `yaml:"path"`
+	Timeout time.Duration `yaml:"timeout"`
+	Retries int           `yaml:"retries"`
+	Backoff configBackoff `yaml:"backoff"`
+	RetryOn []int         `yaml:"retry_on"`
+
+	TLS      *configTargetTLS `yaml:"tls"`
+	Protocol string           `yaml:"protocol"`
+
+	CircuitBreaker *configCircuitBreaker `yaml:"circuit_breaker"`
+	Chaos          *configChaosSpec      `yaml:"chaos"`
+
+	configPropagation `yaml:",inline"`
+}
+
+type configChaosDelay struct {
+	Distribution string                   `yaml:"distribution"`
+	Duration     time.Duration            `yaml:"duration"`
+	Min          time.Duration            `yaml:"min"`
+	Max          time.Duration            `yaml:"max"`
+	Mean         time.Duration            `yaml:"mean"`
+	StdDev       time.Duration            `yaml:"stddev"`
+	Percentiles  map[string]time.Duration `yaml:"percentiles"`
+	Probability  float64                  `yaml:"p"`
+}
+
+type configChaosError struct {
+	StatusCode  int     `yaml:"status_code"`
+	Message     string  `yaml:"message"`
+	Probability float64 `yaml:"p"`
+}
+
+type configChaosFault struct {
+	Type        string  `yaml:"type"`
+	Rate        int     `yaml:"rate"`
+	Probability float64 `yaml:"p"`
+}
+
+type configChaosSpec struct {
+	Delay    *configChaosDelay `yaml:"delay"`
+	Error    *configChaosError `yaml:"error"`
+	Fault    *configChaosFault `yaml:"fault"`
+	Duration time.Duration     `yaml:"duration"`
+}
+
+type configChaosRoute struct {
+	Method  string `yaml:"method"`
+	Route   string `yaml:"route"`
+	URL     string `yaml:"url"`
+	Service string `yaml:"service"`
+	Path    string `yaml:"path"`
+
+	configChaosSpec `yaml:",inline"`
+}
+
+type configChaosScenarioStep struct {
+	At    time.Duration `yaml:"at"`
+	Clear bool          `yaml:"clear"`
+
+	configChaosRoute `yaml:",inline"`
+}
+
+type configChaosScenario struct {
+	Name      string                    `yaml:"name"`
+	Autostart bool                      `yaml:"autostart"`
+	Steps     []configChaosScenarioStep `yaml:"steps"`
+}
+
+type configResponse struct {
+	Status      int               `yaml:"status"`
+	Headers     map[string]string `yaml:"headers"`
+	ContentType string            `yaml:"content_type"`
+	Body        string            `yaml:"body"`
+	BodyFile    string            `yaml:"body_file"`
+	Weight      int               `yaml:"weight"`
+}
+
+type configResource struct {
+	IDField  string        `yaml:"id_field"`
+	IDType   string        `yaml:"id_type"`
+	PageSize int           `yaml:"page_size"`
+	Seed     []interface{} `yaml:"seed"`
+	SeedFile string        `yaml:"seed_file"`
 }
 
 type configEndpoint struct {
-	Method         string                 `yaml:"method"`
-	Route          string                 `yaml:"route"`
-	ResponseStatus int                    `yaml:"response_status"`
-	ResponseBody   string                 `yaml:"response_body"`
-	Chain          []configEndpointTarget `yaml:"chain"`
+	Method           string                 `yaml:"method"`
+	Route            string                 `yaml:"route"`
+	ResponseStatus   int                    `yaml:"response_status"`
+	ResponseHeaders  map[string]string      `yaml:"response_headers"`
+	ContentType      string                 `yaml:"content_type"`
+	ResponseBody     string                 `yaml:"response_body"`
+	ResponseBodyFile string                 `yaml:"response_body_file"`
+	Responses        []configResponse       `yaml:"responses"`
+	ResponsesMode    string                 `yaml:"responses_mode"`
+	ResponsesSeed    int64                  `yaml:"responses_seed"`
+	Chain            []configEndpointTarget `yaml:"chain"`
+	ChainMode        string                 `yaml:"chain_mode"`
+	RetryBudget      float64                `yaml:"retry_budget"`
+	Resource         *configResource        `yaml:"resource"`
+	Chaos            *configChaosSpec       `yaml:"chaos"`
+
+	configPropagation `yaml:",inline"`
 }
 
 type config struct {
-	Metrics   configMetrics     `yaml:metrics`
-	Endpoints []*configEndpoint `yaml:"api_endpoints"`
+	Server    configServer        `yaml:"server"`
+	Metrics   configMetrics       `yaml:"metrics"`
+	Tracing   configTracing       `yaml:"tracing"`
+	AccessLog configAccessLog     `yaml:"access_log"`
+	Health    configHealth        `yaml:"health"`
+	Shutdown  configShutdown      `yaml:"shutdown"`
+	Endpoints []*configEndpoint   `yaml:"api_endpoints"`
+	Chaos     []*configChaosRoute `yaml:"chaos"`
+
+	ChaosScenarios []*configChaosScenario `yaml:"chaos_scenarios"`
 }
 
+// loadConfig loads the configuration file at path.
 func loadConfig(path string) (*config, error) {
-	var c = config{
-		Metrics: configMetrics{
-			LatencyHistogramBuckets: defaultMetricsLatencyHistogramBuckets,
-		},
-	}
-
 	if _, err := os.Stat(path); err != nil {
 		return nil, err
 	}
@@ -50,9 +233,128 @@ func loadConfig(path string) (*config, error) {
 		return nil, err
 	}
 
+	return parseConfig(data, path)
+}
+
+// parseConfig parses the YAML configuration data, the relative paths it contains being resolved against the
+// directory of the file at path.
+func parseConfig(data []byte, path string) (*config, error) {
+	var c = config{
+		Metrics: configMetrics{
+			LatencyHistogramBuckets: defaultMetricsLatencyHistogramBuckets,
+			SizeHistogramBuckets:    defaultMetricsSizeHistogramBuckets,
+			Tags:                    defaultMetricsTags,
+		},
+		Tracing: configTracing{
+			ServiceName:  defaultTracingServiceName,
+			SamplingRate: defaultTracingSamplingRate,
+		},
+		AccessLog: configAccessLog{
+			Format: defaultAccessLogFormat,
+			Output: defaultAccessLogOutput,
+		},
+		Health: configHealth{
+			Healthy:        true,
+			Ready:          true,
+			TargetsPath:    defaultHealthTargetsPath,
+			TargetsTimeout: defaultHealthTargetsTimeout,
+		},
+		Shutdown: configShutdown{
+			DrainTimeout: defaultShutdownDrainTimeout,
+		},
+	}
+
 	if err := yaml.Unmarshal(data, &c); err != nil {
 		return nil, fmt.Errorf("failed to unmarshal YAML data")
 	}
 
+	// Resolve response body files paths relative to the configuration file directory
+	for _, e := range c.Endpoints {
+		if e.ResponseBodyFile != "" && !filepath.IsAbs(e.ResponseBodyFile) {
+			e.ResponseBodyFile = filepath.Join(filepath.Dir(path), e.ResponseBodyFile)
+		}
+
+		if e.Resource != nil && e.Resource.SeedFile != "" && !filepath.IsAbs(e.Resource.SeedFile) {
+			e.Resource.SeedFile = filepath.Join(filepath.Dir(path), e.Resource.SeedFile)
+		}
+
+		for i := range e.Responses {
+			if e.Responses[i].BodyFile != "" && !filepath.IsAbs(e.Responses[i].BodyFile) {
+				e.Responses[i].BodyFile = filepath.Join(filepath.Dir(path), e.Responses[i].BodyFile)
+			}
+		}
+	}
+
+	if o := c.AccessLog.Output; o != "stdout" && o != "stderr" && o != "" && !filepath.IsAbs(o) {
+		c.AccessLog.Output = filepath.Join(filepath.Dir(path), o)
+	}
+
+	if t := c.Server.TLS; t != nil {
+		t.CertFile = resolveConfigPath(path, t.CertFile)
+		t.KeyFile = resolveConfigPath(path, t.KeyFile)
+		t.ClientCAFile = resolveConfigPath(path, t.ClientCAFile)
+	}
+
+	for _, e := range c.Endpoints {
+		for i := range e.Chain {
+			if t := e.Chain[i].TLS; t != nil {
+				t.CAFile = resolveConfigPath(path, t.CAFile)
+				t.CertFile = resolveConfigPath(path, t.CertFile)
+				t.KeyFile = resolveConfigPath(path, t.KeyFile)
+			}
+		}
+	}
+
+	for i := range c.Tracing.Exporters {
+		if p := c.Tracing.Exporters[i].Path; p != "" && !filepath.IsAbs(p) {
+			c.Tracing.Exporters[i].Path = filepath.Join(filepath.Dir(path), p)
+		}
+	}
+
 	return &c, nil
 }
+
+// resolveConfigPath returns the path p relative to the directory of the configuration file at path, unless p is
+// empty or absolute.
+func resolveConfigPath(path, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+
+	return filepath.Join(filepath.Dir(path), p)
+}
+
+// watchConfig polls the configuration file at path every interval, calling the changed function when its content
+// changes. The file content is compared rather than its modification time, so that updates performed by swapping
+// symbolic links (e.g. Kubernetes ConfigMap volumes) are detected as well.
+func watchConfig(path string, interval time.Duration, changed func()) {
+	last, err := checksumFile(path)
+	if err != nil {
+		log.Warning("unable to read configuration file: %s", err)
+	}
+
+	for range time.Tick(interval) {
+		sum, err := checksumFile(path)
+		if err != nil {
+			log.Warning("unable to read configuration file: %s", err)
+			continue
+		}
+
+		if !bytes.Equal(sum, last) {
+			log.Info("configuration file %s changed", path)
+			last = sum
+			changed()
+		}
+	}
+}
+
+func checksumFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+
+	return sum[:], nil
+}
@@ -8,67 +8,235 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/facette/httputil"
+	"github.com/gorilla/mux"
+	"go.opencensus.io/trace"
 )
 
 type endpointTarget struct {
-	client *http.Client
-	method string
-	url    *url.URL
+	client    *http.Client
+	transport *http.Transport
+	method    string
+	rawURL    string
+	url       *url.URL
+	service   string
+	timeout   time.Duration
+	retries   int
+	retryOn   map[int]bool
+	backoff   *backoff
+	budget    *retryBudget
+	breaker   *circuitBreaker
+
+	tls      *configTargetTLS
+	protocol string
+
+	propagation *propagation
+}
+
+func newEndpointTarget(config *configEndpointTarget, propagation *configPropagation, budget *retryBudget,
+	chaos *chaos) (*endpointTarget, error) {
+	var (
+		t = endpointTarget{
+			budget:   budget,
+			service:  config.Service,
+			tls:      config.TLS,
+			protocol: config.Protocol,
+		}
+		err error
+	)
+
+	if config.Method == "" {
+		return nil, fmt.Errorf("missing remote endpoint method")
+	}
+	t.method = config.Method
+
+	if config.URL == "" {
+		return nil, fmt.Errorf("missing remote endpoint URL")
+	}
+
+	// The target URL can contain route variables placeholders (e.g. "{id}"), expanded at request time
+	t.rawURL = config.URL
+	if t.url, err = url.Parse(config.URL); err != nil {
+		return nil, fmt.Errorf("URL: %s", err)
+	}
+
+	if t.transport, err = newTargetTransport(t.url, config.TLS, config.Protocol); err != nil {
+		return nil, err
+	}
+	t.client = &http.Client{Transport: chaos.transport(t.transport)}
+
+	if config.Timeout < 0 {
+		return nil, fmt.Errorf("timeout must be positive")
+	}
+	t.timeout = config.Timeout
+
+	if config.Retries < 0 {
+		return nil, fmt.Errorf("retries must be positive")
+	}
+	t.retries = config.Retries
+
+	retryOn := config.RetryOn
+	if retryOn == nil {
+		retryOn = defaultRetryOn
+	}
+	t.retryOn = make(map[int]bool)
+	for _, code := range retryOn {
+		t.retryOn[code] = true
+	}
+
+	if t.backoff, err = newBackoff(&config.Backoff); err != nil {
+		return nil, err
+	}
+
+	if config.CircuitBreaker != nil {
+		if t.breaker, err = newCircuitBreaker(t.method+" "+t.rawURL, config.CircuitBreaker); err != nil {
+			return nil, fmt.Errorf("circuit breaker: %s", err)
+		}
+	}
+
+	if t.propagation, err = newPropagation(propagation, &config.configPropagation); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
 }
 
 func (e *endpointTarget) MarshalJSON() ([]byte, error) {
-	return json.Marshal(map[string]interface{}{
+	je := map[string]interface{}{
 		"method": e.method,
-		"url":    e.url.String(),
-	})
+		"url":    e.rawURL,
+	}
+
+	if e.service != "" {
+		je["service"] = e.service
+	}
+
+	if e.timeout > 0 {
+		je["timeout"] = e.timeout.String()
+	}
+
+	if e.retries > 0 {
+		retryOn := make([]int, 0, len(e.retryOn))
+		for code := range e.retryOn {
+			retryOn = append(retryOn, code)
+		}
+		sort.Ints(retryOn)
+
+		je["retries"] = e.retries
+		je["retry_on"] = retryOn
+		je["backoff"] = e.backoff
+	}
+
+	if e.breaker != nil {
+		je["circuit_breaker"] = e.breaker
+	}
+
+	if e.tls != nil {
+		jt := map[string]interface{}{}
+		for k, v := range map[string]string{
+			"ca_file":     e.tls.CAFile,
+			"cert_file":   e.tls.CertFile,
+			"key_file":    e.tls.KeyFile,
+			"server_name": e.tls.ServerName,
+		} {
+			if v != "" {
+				jt[k] = v
+			}
+		}
+
+		if e.tls.InsecureSkipVerify {
+			jt["insecure_skip_verify"] = true
+		}
+
+		je["tls"] = jt
+	}
+
+	if e.protocol != "" {
+		je["protocol"] = e.protocol
+	}
+
+	if len(e.propagation.forwardHeaders) > 0 {
+		je["forward_headers"] = e.propagation.forwardHeaders
+	}
+
+	if len(e.propagation.requestHeaders) > 0 {
+		je["request_headers"] = e.propagation.requestHeaders
+	}
+
+	if e.propagation.forwardBody {
+		je["forward_body"] = true
+	}
+
+	return json.Marshal(je)
 }
 
 func (e *endpointTarget) request(ctx context.Context) (*http.Response, error) {
-	e.client = http.DefaultClient
+	targetURL := expandRouteVars(ctx, e.rawURL)
 
-	log.Debug("requesting target endpoint: %s %s", e.method, e.url.String())
+	log.Debug("requesting target endpoint: %s %s", e.method, targetURL)
 
-	req, err := http.NewRequest(e.method, e.url.String(), nil)
+	data, _ := ctx.Value(requestDataContextKey).(*templateData)
+
+	req, err := http.NewRequest(e.method, targetURL, e.propagation.body(data))
 	if err != nil {
 		return nil, err
 	}
 
+	if err := e.propagation.apply(req, data); err != nil {
+		return nil, fmt.Errorf("unable to render request headers: %s", err)
+	}
+
+	injectSpanContext(trace.FromContext(ctx).SpanContext(), req.Header)
+
+	// Outbound chaos specifications are set for the target URL rather than the expanded one
+	ctx = context.WithValue(ctx, chaosTargetContextKey, e.url.Host+e.url.Path)
+
 	return e.client.Do(req.WithContext(ctx))
 }
 
 type endpoint struct {
 	method          string
 	route           string
-	responseStatus  int
 	responseHeaders map[string]string
-	responseBody    string
-	targets         []endpointTarget
+	customHeaders   map[string]string
+	headerTmpls     headerTemplates
+	responses       *responseSelector
+	variants        bool
+	targets         []*endpointTarget
+	chainMode       chainMode
+	retryBudget     *retryBudget
+	resource        *resource
 }
 
-func newEndpoint(method, route string, responseStatus int, responseBody string,
-	targets []configEndpointTarget) (*endpoint, error) {
+// endpointRoute is a route served by an endpoint.
+type endpointRoute struct {
+	method  string
+	route   string
+	handler http.HandlerFunc
+}
+
+func newEndpoint(config *configEndpoint, chaos *chaos) (*endpoint, error) {
 	var (
 		e   endpoint
 		err error
 	)
 
-	if method == "" {
+	if config.Method == "" && config.Resource == nil {
 		return nil, fmt.Errorf("method not specified")
 	}
-	e.method = method
+	e.method = config.Method
 
-	if route == "" {
+	if config.Route == "" {
 		return nil, fmt.Errorf("route not specified")
 	}
-	e.route = route
-
-	if (responseStatus < 100 || responseStatus > 599) && targets == nil {
-		return nil, fmt.Errorf("invalid response status code")
+	e.route = apiPrefix + config.Route
+	if err := checkRoute(e.route); err != nil {
+		return nil, fmt.Errorf("invalid route: %s", err)
 	}
-	e.responseStatus = responseStatus
 
 	e.responseHeaders = map[string]string{
 		"Version": version,
@@ -81,75 +249,214 @@ func newEndpoint(method, route string, responseStatus int, responseBody string,
 		}
 	}
 
-	e.responseBody = responseBody
+	e.customHeaders = config.ResponseHeaders
+	if e.headerTmpls, err = newHeaderTemplates(e.customHeaders); err != nil {
+		return nil, err
+	}
+
+	if config.Chain == nil &&
+		(len(config.ForwardHeaders) > 0 || len(config.RequestHeaders) > 0 || config.ForwardBody) {
+		return nil, fmt.Errorf("headers and body propagation is only supported by chained endpoints")
+	}
+
+	if config.Resource != nil {
+		if config.Method != "" || config.Chain != nil || len(config.Responses) > 0 {
+			return nil, fmt.Errorf("method, chain and responses are not supported by resource endpoints")
+		}
+
+		if e.resource, err = newResource(config.Resource); err != nil {
+			return nil, fmt.Errorf("invalid resource: %s", err)
+		}
+
+		return &e, nil
+	}
+
+	if config.Chain == nil {
+		var responses []*response
 
-	if targets != nil {
-		e.targets = make([]endpointTarget, len(targets))
-		for i := range targets {
-			if targets[i].Method == "" {
-				return nil, fmt.Errorf("invalid endpoint chain: missing remote endpoint method")
+		if len(config.Responses) > 0 {
+			e.variants = true
+
+			responses = make([]*response, len(config.Responses))
+			for i := range config.Responses {
+				rc := config.Responses[i]
+				if rc.ContentType == "" {
+					rc.ContentType = config.ContentType
+				}
+
+				if responses[i], err = newResponse(&rc); err != nil {
+					return nil, fmt.Errorf("invalid response #%d: %s", i+1, err)
+				}
 			}
-			e.targets[i].method = targets[i].Method
+		} else {
+			r, err := newResponse(&configResponse{
+				Status:      config.ResponseStatus,
+				ContentType: config.ContentType,
+				Body:        config.ResponseBody,
+				BodyFile:    config.ResponseBodyFile,
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			responses = []*response{r}
+		}
+
+		if e.responses, err = newResponseSelector(config.ResponsesMode, config.ResponsesSeed, responses); err != nil {
+			return nil, err
+		}
+	} else if len(config.Responses) > 0 {
+		return nil, fmt.Errorf("responses and chain are mutually exclusive")
+	}
 
-			if targets[i].URL == "" {
-				return nil, fmt.Errorf("invalid endpoint chain: missing remote endpoint URL")
+	if targets := config.Chain; targets != nil {
+		if config.RetryBudget != 0 {
+			if e.retryBudget, err = newRetryBudget(config.RetryBudget); err != nil {
+				return nil, fmt.Errorf("invalid endpoint chain: %s", err)
 			}
+		}
 
-			if e.targets[i].url, err = url.Parse(targets[i].URL); err != nil {
-				return nil, fmt.Errorf("invalid endpoint chain: URL: %s", err)
+		e.targets = make([]*endpointTarget, len(targets))
+		for i := range targets {
+			e.targets[i], err = newEndpointTarget(&targets[i], &config.configPropagation, e.retryBudget, chaos)
+			if err != nil {
+				return nil, fmt.Errorf("invalid endpoint chain: %s", err)
 			}
 		}
+
+		if e.chainMode, err = parseChainMode(config.ChainMode, len(targets)); err != nil {
+			return nil, fmt.Errorf("invalid endpoint chain: %s", err)
+		}
 	}
 
 	return &e, nil
 }
 
-func (e *endpoint) handler(rw http.ResponseWriter, r *http.Request) {
-	for k, v := range e.responseHeaders {
-		rw.Header().Set("X-Flapi-"+k, v)
+func (e *endpoint) String() string {
+	if e.resource != nil {
+		return "resource " + e.route
 	}
 
-	if e.targets == nil {
-		rw.WriteHeader(e.responseStatus)
-		fmt.Fprintf(rw, "%s\n", e.responseBody)
-	} else {
-		finalStatus := http.StatusOK
-		targetResponses := make([]string, len(e.targets))
+	return e.method + " " + e.route
+}
 
-		// TODO: request targets concurrently with goroutines
-		for i, t := range e.targets {
-			res, err := t.request(r.Context())
-			if err != nil {
-				finalStatus = http.StatusInternalServerError
-				targetResponses[i] = fmt.Sprintf("error: %s", err)
-				continue
-			}
-			defer res.Body.Close()
+// routes returns the routes served by the endpoint.
+func (e *endpoint) routes() []endpointRoute {
+	if e.resource != nil {
+		routes := e.resource.routes(e.route)
+		for i := range routes {
+			routes[i].handler = e.resourceHandler(routes[i].handler)
+		}
+
+		return routes
+	}
 
-			data, err := ioutil.ReadAll(res.Body)
+	return []endpointRoute{{method: e.method, route: e.route, handler: e.handler}}
+}
+
+// resourceHandler wraps a resource route handler to set the endpoint response headers.
+func (e *endpoint) resourceHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(rw http.ResponseWriter, r *http.Request) {
+		for k, v := range e.responseHeaders {
+			rw.Header().Set("X-Flapi-"+k, v)
+		}
+
+		if len(e.headerTmpls) > 0 {
+			data, err := newTemplateData(r)
+			if err == nil {
+				err = e.headerTmpls.render(rw.Header(), data)
+			}
 			if err != nil {
-				finalStatus = http.StatusInternalServerError
-				continue
+				e.renderError(rw, err)
+				return
 			}
 
-			targetResponses[i] = fmt.Sprintf("HTTP %s: %s", res.Status, strings.TrimSpace(string(data)))
+			// The request body has been consumed by the template data
+			r.Body = ioutil.NopCloser(strings.NewReader(data.RawBody))
+		}
+
+		handler(rw, r)
+	}
+}
+
+func (e *endpoint) handler(rw http.ResponseWriter, r *http.Request) {
+	var (
+		data *templateData
+		err  error
+	)
+
+	for k, v := range e.responseHeaders {
+		rw.Header().Set("X-Flapi-"+k, v)
+	}
+
+	if data, err = newTemplateData(r); err != nil {
+		e.renderError(rw, err)
+		return
+	}
+
+	if err := e.headerTmpls.render(rw.Header(), data); err != nil {
+		e.renderError(rw, err)
+		return
+	}
+
+	if e.targets == nil {
+		if err := e.responses.pick().write(rw, data); err != nil {
+			e.renderError(rw, err)
 		}
+	} else {
+		ctx := context.WithValue(r.Context(), routeVarsContextKey, mux.Vars(r))
+		ctx = context.WithValue(ctx, requestDataContextKey, data)
+		finalStatus, targetResponses := e.requestChain(ctx)
 
 		httputil.WriteJSON(rw, targetResponses, finalStatus)
 	}
 }
 
+func (e *endpoint) renderError(rw http.ResponseWriter, err error) {
+	log.Error("unable to render endpoint %s %s response: %s", e.method, e.route, err)
+
+	http.Error(rw, fmt.Sprintf("Unable to render response: %s", err), http.StatusInternalServerError)
+}
+
 func (e *endpoint) MarshalJSON() ([]byte, error) {
 	je := map[string]interface{}{
 		"method": e.method,
 		"route":  e.route,
 	}
 
-	if e.targets != nil {
+	if e.resource != nil {
+		delete(je, "method")
+		je["resource"] = e.resource
+	} else if e.targets != nil {
 		je["targets"] = e.targets
+		je["chain_mode"] = e.chainMode.String()
+		if e.retryBudget != nil {
+			je["retry_budget"] = e.retryBudget.ratio
+		}
+	} else if e.variants {
+		je["responses"] = e.responses.responses
+		je["responses_mode"] = e.responses.mode
+		if e.responses.seed != 0 {
+			je["responses_seed"] = e.responses.seed
+		}
 	} else {
-		je["response_status"] = e.responseStatus
-		je["response_body"] = e.responseBody
+		r := e.responses.responses[0]
+
+		je["response_status"] = r.status
+
+		if r.bodyFile != "" {
+			je["response_body_file"] = r.bodyFile
+		} else {
+			je["response_body"] = r.body
+		}
+
+		if r.contentType != "" {
+			je["content_type"] = r.contentType
+		}
+	}
+
+	if len(e.customHeaders) > 0 {
+		je["response_headers"] = e.customHeaders
 	}
 
 	return json.Marshal(je)
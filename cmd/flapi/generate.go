@@ -0,0 +1,710 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/facette/logger"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	generateK8s     = "k8s"
+	generateCompose = "compose"
+
+	// generatePort and generateChaosPort are the ports the API and chaos management listeners of the generated
+	// services containers are bound to.
+	generatePort      = 8000
+	generateChaosPort = 8666
+
+	// generateConfigPath is the path of the configuration file in the generated services containers.
+	generateConfigPath = "/etc/flapi/flapi.yaml"
+
+	defaultGenerateImage               = "falzm/flapi"
+	defaultGenerateReplicas            = 1
+	defaultGenerateConfigWatchInterval = 10 * time.Second
+
+	// generateMinGracePeriod is the minimum termination grace period of the generated services (i.e. the
+	// Kubernetes default one).
+	generateMinGracePeriod = 30 * time.Second
+)
+
+// generateOptions are the deployment settings common to the generated services.
+type generateOptions struct {
+	image               string
+	replicas            int
+	configWatchInterval time.Duration
+	logLevel            string
+	source              string
+}
+
+// generatedService is a topology service along with its generated configuration file content.
+type generatedService struct {
+	*configTopologyService
+
+	data    string
+	targets []string
+}
+
+// newGeneratedServices returns the topology services with their standalone configuration, the chain targets and
+// chaos specifications referencing topology services being resolved to the deployed services URLs.
+func newGeneratedServices(t *configTopology) ([]*generatedService, error) {
+	if err := t.resolveServices(deployedServiceURL); err != nil {
+		return nil, err
+	}
+
+	urls := make(map[string]string)
+	for _, s := range t.Services {
+		urls[s.Name] = deployedServiceURL(s)
+	}
+
+	services := make([]*generatedService, len(t.Services))
+	for i, s := range t.Services {
+		var settings yaml.MapSlice
+
+		for _, item := range t.settings {
+			// Deployed services are standalone, their spans must carry their own name
+			if item.Key == "tracing" {
+				if tracing, ok := item.Value.(yaml.MapSlice); ok {
+					item.Value = setMapSliceValue(tracing, "service_name", s.Name)
+				}
+			}
+
+			settings = append(settings, item)
+		}
+
+		settings = append(settings, rewriteServiceReferences(s.settings, urls)...)
+
+		data, err := yaml.Marshal(settings)
+		if err != nil {
+			return nil, fmt.Errorf("service %q: unable to encode configuration: %s", s.Name, err)
+		}
+
+		services[i] = &generatedService{
+			configTopologyService: s,
+			data:                  "---\n" + string(data),
+			targets:               serviceTargets(s.config),
+		}
+
+		for _, f := range configLocalFiles(s.config) {
+			log.Warning("service %q: %s must be made available to the deployed service", s.Name, f)
+		}
+	}
+
+	return services, nil
+}
+
+// deployedServiceURL returns the base URL of the deployed service s, reachable using its name.
+func deployedServiceURL(s *configTopologyService) string {
+	scheme := "http"
+	if s.config.Server.TLS != nil {
+		scheme = "https"
+	}
+
+	return fmt.Sprintf("%s://%s:%d", scheme, s.Name, generatePort)
+}
+
+// rewriteServiceReferences returns the configuration settings with the service and path parameters of the chain
+// targets and chaos specifications referencing topology services replaced by the url parameter, urls mapping the
+// services names to their base URLs.
+func rewriteServiceReferences(settings yaml.MapSlice, urls map[string]string) yaml.MapSlice {
+	rewrite := func(v interface{}) interface{} {
+		m, ok := v.(yaml.MapSlice)
+		if !ok {
+			return v
+		}
+
+		service, ok := mapSliceValue(m, "service").(string)
+		if !ok {
+			return m
+		}
+
+		path, _ := mapSliceValue(m, "path").(string)
+
+		rewritten := make(yaml.MapSlice, 0, len(m))
+		for _, item := range m {
+			switch item.Key {
+			case "service":
+				rewritten = append(rewritten, yaml.MapItem{Key: "url", Value: urls[service] + path})
+			case "path":
+			default:
+				rewritten = append(rewritten, item)
+			}
+		}
+
+		return rewritten
+	}
+
+	// rewriteList rewrites the items of the list found under key in the items of the list v
+	rewriteList := func(v interface{}, key string) interface{} {
+		list, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+
+		for i := range list {
+			if m, ok := list[i].(yaml.MapSlice); ok {
+				if items, ok := mapSliceValue(m, key).([]interface{}); ok {
+					for j := range items {
+						items[j] = rewrite(items[j])
+					}
+				}
+			}
+		}
+
+		return list
+	}
+
+	result := make(yaml.MapSlice, len(settings))
+	for i, item := range settings {
+		switch item.Key {
+		case "api_endpoints":
+			item.Value = rewriteList(item.Value, "chain")
+
+		case "chaos":
+			if list, ok := item.Value.([]interface{}); ok {
+				for j := range list {
+					list[j] = rewrite(list[j])
+				}
+			}
+
+		case "chaos_scenarios":
+			item.Value = rewriteList(item.Value, "steps")
+		}
+
+		result[i] = item
+	}
+
+	return result
+}
+
+// mapSliceValue returns the value of the key in m, or nil if not found.
+func mapSliceValue(m yaml.MapSlice, key string) interface{} {
+	for _, item := range m {
+		if item.Key == key {
+			return item.Value
+		}
+	}
+
+	return nil
+}
+
+// setMapSliceValue returns a copy of m with key set to value.
+func setMapSliceValue(m yaml.MapSlice, key string, value interface{}) yaml.MapSlice {
+	result := make(yaml.MapSlice, 0, len(m)+1)
+	for _, item := range m {
+		if item.Key != key {
+			result = append(result, item)
+		}
+	}
+
+	return append(result, yaml.MapItem{Key: key, Value: value})
+}
+
+// serviceTargets returns the sorted names of the topology services requested by the chain targets of config.
+func serviceTargets(config *config) []string {
+	var (
+		targets []string
+		seen    = make(map[string]bool)
+	)
+
+	for _, e := range config.Endpoints {
+		for _, t := range e.Chain {
+			if t.Service != "" && !seen[t.Service] {
+				targets = append(targets, t.Service)
+				seen[t.Service] = true
+			}
+		}
+	}
+	sort.Strings(targets)
+
+	return targets
+}
+
+// configLocalFiles returns the settings of config referencing local files, which are not part of the generated
+// configuration.
+func configLocalFiles(config *config) []string {
+	var files []string
+
+	add := func(setting, path string) {
+		if path != "" {
+			files = append(files, fmt.Sprintf("%s file %s", setting, path))
+		}
+	}
+
+	if t := config.Server.TLS; t != nil {
+		add("server certificate", t.CertFile)
+		add("server key", t.KeyFile)
+		add("server client CA", t.ClientCAFile)
+	}
+
+	for _, e := range config.Endpoints {
+		add("response body", e.ResponseBodyFile)
+
+		for _, r := range e.Responses {
+			add("response body", r.BodyFile)
+		}
+
+		if e.Resource != nil {
+			add("resource seed", e.Resource.SeedFile)
+		}
+
+		for _, t := range e.Chain {
+			if t.TLS != nil {
+				add("target CA", t.TLS.CAFile)
+				add("target certificate", t.TLS.CertFile)
+				add("target key", t.TLS.KeyFile)
+			}
+		}
+	}
+
+	return files
+}
+
+// gracePeriod returns the time the service s must be given to shut down gracefully, according to its shutdown
+// settings.
+func (s *generatedService) gracePeriod() time.Duration {
+	shutdown := s.config.Shutdown
+
+	if shutdown.DrainTimeout == 0 {
+		return generateMinGracePeriod
+	}
+
+	// Leave some margin for the process to exit once the exit delay has elapsed
+	period := shutdown.PreStopDelay + shutdown.DrainTimeout + shutdown.ExitDelay + 5*time.Second
+	if period < generateMinGracePeriod {
+		return generateMinGracePeriod
+	}
+
+	return period
+}
+
+// chaosBindAddr returns the address the chaos management listener of the service containers is bound to: the
+// topology chaos bind address if it is a UNIX socket, the container chaos port on all interfaces otherwise.
+func (s *generatedService) chaosBindAddr() string {
+	if strings.HasPrefix(s.ChaosBindAddr, "unix:") {
+		return s.ChaosBindAddr
+	}
+
+	return fmt.Sprintf(":%d", generateChaosPort)
+}
+
+// args returns the command arguments of the service containers.
+func (s *generatedService) args(options *generateOptions) []string {
+	args := []string{"-config", generateConfigPath, "-chaos-bind-addr", s.chaosBindAddr()}
+
+	if options.logLevel != defaultLogLevel {
+		args = append(args, "-log-level", options.logLevel)
+	}
+
+	if options.configWatchInterval > 0 {
+		args = append(args, "-config-watch-interval", options.configWatchInterval.String())
+	}
+
+	return args
+}
+
+type k8sMetadata struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+type k8sSelector struct {
+	MatchLabels map[string]string `yaml:"matchLabels"`
+}
+
+type k8sConfigMap struct {
+	APIVersion string            `yaml:"apiVersion"`
+	Kind       string            `yaml:"kind"`
+	Metadata   k8sMetadata       `yaml:"metadata"`
+	Data       map[string]string `yaml:"data"`
+}
+
+type k8sServicePort struct {
+	Name       string `yaml:"name"`
+	Protocol   string `yaml:"protocol"`
+	Port       int    `yaml:"port"`
+	TargetPort int    `yaml:"targetPort"`
+}
+
+type k8sService struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   k8sMetadata `yaml:"metadata"`
+	Spec       struct {
+		Selector map[string]string `yaml:"selector"`
+		Ports    []k8sServicePort  `yaml:"ports"`
+	} `yaml:"spec"`
+}
+
+type k8sProbe struct {
+	HTTPGet struct {
+		Path   string `yaml:"path"`
+		Port   int    `yaml:"port"`
+		Scheme string `yaml:"scheme"`
+	} `yaml:"httpGet"`
+	PeriodSeconds    int `yaml:"periodSeconds"`
+	TimeoutSeconds   int `yaml:"timeoutSeconds"`
+	FailureThreshold int `yaml:"failureThreshold"`
+}
+
+type k8sContainerPort struct {
+	Name          string `yaml:"name"`
+	ContainerPort int    `yaml:"containerPort"`
+}
+
+type k8sVolumeMount struct {
+	Name      string `yaml:"name"`
+	MountPath string `yaml:"mountPath"`
+	ReadOnly  bool   `yaml:"readOnly"`
+}
+
+type k8sContainer struct {
+	Name           string             `yaml:"name"`
+	Image          string             `yaml:"image"`
+	Args           []string           `yaml:"args"`
+	Ports          []k8sContainerPort `yaml:"ports"`
+	LivenessProbe  k8sProbe           `yaml:"livenessProbe"`
+	ReadinessProbe k8sProbe           `yaml:"readinessProbe"`
+	VolumeMounts   []k8sVolumeMount   `yaml:"volumeMounts"`
+}
+
+type k8sVolume struct {
+	Name      string `yaml:"name"`
+	ConfigMap struct {
+		Name string `yaml:"name"`
+	} `yaml:"configMap"`
+}
+
+type k8sDeployment struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   k8sMetadata `yaml:"metadata"`
+	Spec       struct {
+		Replicas int         `yaml:"replicas"`
+		Selector k8sSelector `yaml:"selector"`
+		Template struct {
+			Metadata k8sMetadata `yaml:"metadata"`
+			Spec     struct {
+				TerminationGracePeriodSeconds int            `yaml:"terminationGracePeriodSeconds"`
+				Containers                    []k8sContainer `yaml:"containers"`
+				Volumes                       []k8sVolume    `yaml:"volumes"`
+			} `yaml:"spec"`
+		} `yaml:"template"`
+	} `yaml:"spec"`
+}
+
+type k8sServiceMonitorEndpoint struct {
+	Port      string          `yaml:"port"`
+	Scheme    string          `yaml:"scheme,omitempty"`
+	TLSConfig map[string]bool `yaml:"tlsConfig,omitempty"`
+}
+
+type k8sServiceMonitor struct {
+	APIVersion string      `yaml:"apiVersion"`
+	Kind       string      `yaml:"kind"`
+	Metadata   k8sMetadata `yaml:"metadata"`
+	Spec       struct {
+		Selector  k8sSelector                 `yaml:"selector"`
+		Endpoints []k8sServiceMonitorEndpoint `yaml:"endpoints"`
+	} `yaml:"spec"`
+}
+
+// generateK8sManifests returns the Kubernetes manifests deploying the topology services: for every service, a ConfigMap
+// holding its configuration file, a Service, a Deployment and a Prometheus operator ServiceMonitor.
+func generateK8sManifests(services []*generatedService, options *generateOptions) ([]byte, error) {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "# Generated by flapi from %s, do not edit.\n", options.source)
+
+	for _, s := range services {
+		var (
+			labels     = map[string]string{"app": s.Name}
+			configName = s.Name + "-conf"
+			scheme     = "HTTP"
+		)
+
+		if s.config.Server.TLS != nil {
+			scheme = "HTTPS"
+		}
+
+		configMap := k8sConfigMap{
+			APIVersion: "v1",
+			Kind:       "ConfigMap",
+			Metadata:   k8sMetadata{Name: configName},
+			Data:       map[string]string{path.Base(generateConfigPath): s.data},
+		}
+
+		service := k8sService{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Metadata:   k8sMetadata{Name: s.Name, Labels: labels},
+		}
+		service.Spec.Selector = labels
+		service.Spec.Ports = []k8sServicePort{{
+			Name:       "http",
+			Protocol:   "TCP",
+			Port:       generatePort,
+			TargetPort: generatePort,
+		}}
+
+		container := k8sContainer{
+			Name:           "flapi",
+			Image:          options.image,
+			Args:           s.args(options),
+			Ports:          []k8sContainerPort{{Name: "http", ContainerPort: generatePort}},
+			LivenessProbe:  newK8sProbe("/healthz", scheme, 10, 1, 3),
+			ReadinessProbe: newK8sProbe("/readyz", scheme, 5, 2, 2),
+			VolumeMounts: []k8sVolumeMount{{
+				Name:      configName,
+				MountPath: path.Dir(generateConfigPath),
+				ReadOnly:  true,
+			}},
+		}
+
+		// The chaos management port is not exposed by the Service, so that it can't be used by the API clients
+		if !strings.HasPrefix(s.chaosBindAddr(), "unix:") {
+			container.Ports = append(container.Ports, k8sContainerPort{Name: "chaos", ContainerPort: generateChaosPort})
+		}
+
+		volume := k8sVolume{Name: configName}
+		volume.ConfigMap.Name = configName
+
+		deployment := k8sDeployment{
+			APIVersion: "apps/v1",
+			Kind:       "Deployment",
+			Metadata:   k8sMetadata{Name: s.Name, Labels: labels},
+		}
+		deployment.Spec.Replicas = options.replicas
+		deployment.Spec.Selector.MatchLabels = labels
+		deployment.Spec.Template.Metadata = k8sMetadata{Name: s.Name, Labels: labels}
+		deployment.Spec.Template.Spec.TerminationGracePeriodSeconds = int(math.Ceil(s.gracePeriod().Seconds()))
+		deployment.Spec.Template.Spec.Containers = []k8sContainer{container}
+		deployment.Spec.Template.Spec.Volumes = []k8sVolume{volume}
+
+		monitor := k8sServiceMonitor{
+			APIVersion: "monitoring.coreos.com/v1",
+			Kind:       "ServiceMonitor",
+			Metadata:   k8sMetadata{Name: s.Name, Labels: map[string]string{"app": s.Name, "monitoring": "flapi"}},
+		}
+		monitor.Spec.Selector.MatchLabels = labels
+		monitor.Spec.Endpoints = []k8sServiceMonitorEndpoint{{Port: "http"}}
+		if s.config.Server.TLS != nil {
+			// Certificates are typically self-signed or issued by a private CA
+			monitor.Spec.Endpoints[0].Scheme = "https"
+			monitor.Spec.Endpoints[0].TLSConfig = map[string]bool{"insecureSkipVerify": true}
+		}
+
+		for _, object := range []interface{}{configMap, service, deployment, monitor} {
+			data, err := yaml.Marshal(object)
+			if err != nil {
+				return nil, fmt.Errorf("service %q: unable to encode manifest: %s", s.Name, err)
+			}
+
+			buf.WriteString("---\n")
+			buf.Write(data)
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func newK8sProbe(path, scheme string, period, timeout, failureThreshold int) k8sProbe {
+	var p = k8sProbe{
+		PeriodSeconds:    period,
+		TimeoutSeconds:   timeout,
+		FailureThreshold: failureThreshold,
+	}
+
+	p.HTTPGet.Path = path
+	p.HTTPGet.Port = generatePort
+	p.HTTPGet.Scheme = scheme
+
+	return p
+}
+
+type composeService struct {
+	Image           string                 `yaml:"image"`
+	Command         []string               `yaml:"command"`
+	Ports           []string               `yaml:"ports,omitempty"`
+	Configs         []composeServiceConfig `yaml:"configs"`
+	DependsOn       []string               `yaml:"depends_on,omitempty"`
+	StopGracePeriod string                 `yaml:"stop_grace_period"`
+	Deploy          *struct {
+		Replicas int `yaml:"replicas"`
+	} `yaml:"deploy,omitempty"`
+}
+
+type composeServiceConfig struct {
+	Source string `yaml:"source"`
+	Target string `yaml:"target"`
+}
+
+// generateComposeFile returns the Docker Compose file deploying the topology services. The services API and chaos
+// management listeners ports are published on the host according to the topology bind addresses, so that the
+// deployed topology is reachable as if run by flapi.
+func generateComposeFile(services []*generatedService, options *generateOptions) ([]byte, error) {
+	var (
+		buf     bytes.Buffer
+		compose = struct {
+			Services yaml.MapSlice `yaml:"services"`
+			Configs  yaml.MapSlice `yaml:"configs"`
+		}{}
+	)
+
+	for _, s := range services {
+		var (
+			service = composeService{
+				Image:           options.image,
+				Command:         s.args(options),
+				DependsOn:       s.targets,
+				StopGracePeriod: s.gracePeriod().String(),
+				Configs:         []composeServiceConfig{{Source: s.Name, Target: generateConfigPath}},
+			}
+		)
+
+		if options.replicas != 1 {
+			service.Deploy = &struct {
+				Replicas int `yaml:"replicas"`
+			}{options.replicas}
+		} else {
+			if p := composePort(s.BindAddr, generatePort); p != "" {
+				service.Ports = append(service.Ports, p)
+			}
+
+			if p := composePort(s.ChaosBindAddr, generateChaosPort); p != "" {
+				service.Ports = append(service.Ports, p)
+			}
+		}
+
+		compose.Services = append(compose.Services, yaml.MapItem{Key: s.Name, Value: service})
+
+		// Compose interpolates variables in the whole file, including the configurations content
+		compose.Configs = append(compose.Configs, yaml.MapItem{
+			Key:   s.Name,
+			Value: map[string]string{"content": strings.Replace(s.data, "$", "$$", -1)},
+		})
+	}
+
+	data, err := yaml.Marshal(compose)
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode compose file: %s", err)
+	}
+
+	fmt.Fprintf(&buf, "# Generated by flapi from %s, do not edit.\n", options.source)
+	buf.Write(data)
+
+	return buf.Bytes(), nil
+}
+
+// composePort returns the port publishing specification of the container port to the host port of the topology
+// bind address bindAddr, or an empty string if bindAddr is not a TCP address.
+func composePort(bindAddr string, port int) string {
+	host, hostPort, err := net.SplitHostPort(bindAddr)
+	if err != nil {
+		return ""
+	}
+
+	if host == "" {
+		return fmt.Sprintf("%s:%d", hostPort, port)
+	}
+
+	return fmt.Sprintf("%s:%s:%d", host, hostPort, port)
+}
+
+// runGenerate is the generate command, generating the deployment manifests of a topology.
+func runGenerate(args []string) {
+	var (
+		flags           = flag.NewFlagSet("generate", flag.ExitOnError)
+		flagImage       string
+		flagReplicas    int
+		flagConfigWatch time.Duration
+		flagLogLevel    string
+		flagOutputPath  string
+		options         generateOptions
+		data            []byte
+	)
+
+	image := defaultGenerateImage + ":" + version
+	if version == "" {
+		image = defaultGenerateImage + ":latest"
+	}
+
+	flags.StringVar(&flagImage, "image", image, "container image of the services")
+	flags.IntVar(&flagReplicas, "replicas", defaultGenerateReplicas, "number of replicas of every service")
+	flags.DurationVar(&flagConfigWatch, "config-watch-interval", defaultGenerateConfigWatchInterval, "services configuration file changes polling interval (0 to disable)")
+	flags.StringVar(&flagLogLevel, "log-level", defaultLogLevel, "logging level of the services")
+	flags.StringVar(&flagOutputPath, "output", "", "path to the file to write (default: standard output)")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s generate [options] <%s|%s> <topology file>\n\nOptions:\n",
+			path.Base(os.Args[0]), generateK8s, generateCompose)
+		flags.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(os.Stderr, "   -%s  %s (default: %q)\n", f.Name, f.Usage, f.DefValue)
+		})
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	if target := flags.Arg(0); target != generateK8s && target != generateCompose {
+		dieOnError("unsupported target %q", target)
+	}
+
+	if flagReplicas < 1 {
+		dieOnError("replicas must be greater than 0")
+	}
+
+	if _, err := logger.NewLogger(logger.FileConfig{Level: flagLogLevel}); err != nil {
+		dieOnError("invalid log level %q: %s", flagLogLevel, err)
+	}
+
+	options = generateOptions{
+		image:               flagImage,
+		replicas:            flagReplicas,
+		configWatchInterval: flagConfigWatch,
+		logLevel:            flagLogLevel,
+		source:              flags.Arg(1),
+	}
+
+	topology, err := readTopology(flags.Arg(1))
+	if err != nil {
+		dieOnError("unable to load topology: %s", err)
+	}
+
+	services, err := newGeneratedServices(topology)
+	if err != nil {
+		dieOnError("unable to load topology: %s", err)
+	}
+
+	switch flags.Arg(0) {
+	case generateK8s:
+		data, err = generateK8sManifests(services, &options)
+
+	case generateCompose:
+		data, err = generateComposeFile(services, &options)
+	}
+	if err != nil {
+		dieOnError("%s", err)
+	}
+
+	if flagOutputPath == "" {
+		os.Stdout.Write(data)
+		return
+	}
+
+	if err := ioutil.WriteFile(flagOutputPath, data, 0644); err != nil {
+		dieOnError("unable to write output: %s", err)
+	}
+}
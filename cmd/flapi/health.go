@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/facette/httputil"
+)
+
+const (
+	defaultHealthTargetsPath    = "/healthz"
+	defaultHealthTargetsTimeout = time.Second
+)
+
+// health holds the service health state reported by the liveness (/healthz) and readiness (/readyz) endpoints. The
+// state is set from the configuration and can be changed at runtime using the chaos management API, so that failing
+// instances can be simulated.
+type health struct {
+	healthy        bool
+	ready          bool
+	shuttingDown   bool
+	delay          time.Duration
+	checkTargets   bool
+	targetsPath    string
+	targetsTimeout time.Duration
+
+	// endpoints returns the service API endpoints, whose chain targets are checked if checkTargets is true
+	endpoints func() []*endpoint
+
+	sync.RWMutex
+}
+
+func newHealth(endpoints func() []*endpoint) *health {
+	return &health{
+		healthy:   true,
+		ready:     true,
+		endpoints: endpoints,
+	}
+}
+
+// checkHealthConfig checks that the health configuration is valid.
+func checkHealthConfig(config *configHealth) error {
+	if config.Delay < 0 {
+		return fmt.Errorf("delay must be positive")
+	}
+
+	if config.TargetsTimeout <= 0 {
+		return fmt.Errorf("targets timeout must be greater than 0")
+	}
+
+	if config.TargetsPath == "" || config.TargetsPath[0] != '/' {
+		return fmt.Errorf("targets path must start with /")
+	}
+
+	return nil
+}
+
+// configure replaces the current health state, including the changes made using the chaos management API.
+func (h *health) configure(config *configHealth) {
+	h.Lock()
+	defer h.Unlock()
+
+	h.healthy = config.Healthy
+	h.ready = config.Ready
+	h.delay = config.Delay
+	h.checkTargets = config.CheckTargets
+	h.targetsPath = config.TargetsPath
+	h.targetsTimeout = config.TargetsTimeout
+}
+
+// setShuttingDown makes the service report not being ready regardless of its readiness state, so that it stops
+// receiving new requests while shutting down.
+func (h *health) setShuttingDown() {
+	h.Lock()
+	h.shuttingDown = true
+	h.Unlock()
+}
+
+// handleLiveness is the /healthz endpoint handler.
+func (h *health) handleLiveness(rw http.ResponseWriter, r *http.Request) {
+	h.RLock()
+	healthy, delay := h.healthy, h.delay
+	h.RUnlock()
+
+	time.Sleep(delay)
+
+	if !healthy {
+		httputil.WriteJSON(rw, map[string]string{"status": "unhealthy"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	httputil.WriteJSON(rw, map[string]string{"status": "ok"}, http.StatusOK)
+}
+
+// handleReadiness is the /readyz endpoint handler. If targets checking is enabled, the service is reported ready
+// only if all the chain targets are healthy.
+func (h *health) handleReadiness(rw http.ResponseWriter, r *http.Request) {
+	h.RLock()
+	ready, shuttingDown, delay, checkTargets := h.ready, h.shuttingDown, h.delay, h.checkTargets
+	h.RUnlock()
+
+	time.Sleep(delay)
+
+	if shuttingDown {
+		httputil.WriteJSON(rw, map[string]string{"status": "shutting down"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	if !ready {
+		httputil.WriteJSON(rw, map[string]string{"status": "not ready"}, http.StatusServiceUnavailable)
+		return
+	}
+
+	if !checkTargets {
+		httputil.WriteJSON(rw, map[string]string{"status": "ok"}, http.StatusOK)
+		return
+	}
+
+	checks, ok := h.checkTargetsHealth()
+	if !ok {
+		httputil.WriteJSON(rw, map[string]interface{}{"status": "not ready", "targets": checks},
+			http.StatusServiceUnavailable)
+		return
+	}
+
+	httputil.WriteJSON(rw, map[string]interface{}{"status": "ok", "targets": checks}, http.StatusOK)
+}
+
+// checkTargetsHealth checks concurrently the health of the endpoints chain targets hosts, returning the check result
+// of every host and whether they are all healthy. A target is unhealthy if its circuit breaker is open, or if a
+// request to the targets health path on its host doesn't return a 2xx status.
+func (h *health) checkTargetsHealth() (map[string]string, bool) {
+	var (
+		checks  = make(map[string]string)
+		targets = make(map[string]*endpointTarget)
+		ok      = true
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+	)
+
+	h.RLock()
+	path, timeout := h.targetsPath, h.targetsTimeout
+	h.RUnlock()
+
+	for _, e := range h.endpoints() {
+		for _, t := range e.targets {
+			host := t.url.Scheme + "://" + t.url.Host
+
+			if t.breaker != nil && t.breaker.currentState() == breakerOpen {
+				checks[host] = fmt.Sprintf("circuit breaker open for %s %s", t.method, t.rawURL)
+				ok = false
+				delete(targets, host)
+				continue
+			}
+
+			// Hosts are checked using the transport of their first target
+			if _, failed := checks[host]; !failed && targets[host] == nil {
+				targets[host] = t
+			}
+		}
+	}
+
+	for host, t := range targets {
+		wg.Add(1)
+
+		go func(host string, t *endpointTarget) {
+			defer wg.Done()
+
+			var (
+				client = http.Client{Transport: t.transport, Timeout: timeout}
+				result = "ok"
+			)
+
+			if res, err := client.Get(host + path); err != nil {
+				result = err.Error()
+			} else {
+				res.Body.Close()
+
+				if res.StatusCode < 200 || res.StatusCode > 299 {
+					result = fmt.Sprintf("%s returned %s", host+path, res.Status)
+				}
+			}
+
+			mutex.Lock()
+			checks[host] = result
+			if result != "ok" {
+				ok = false
+			}
+			mutex.Unlock()
+		}(host, t)
+	}
+
+	wg.Wait()
+
+	return checks, ok
+}
+
+// healthState is the health state representation used by the chaos management API.
+type healthState struct {
+	Healthy      *bool   `json:"healthy,omitempty"`
+	Ready        *bool   `json:"ready,omitempty"`
+	Delay        *string `json:"delay,omitempty"`
+	CheckTargets *bool   `json:"check_targets,omitempty"`
+}
+
+func (h *health) getState(rw http.ResponseWriter, r *http.Request) {
+	h.RLock()
+	defer h.RUnlock()
+
+	delay := h.delay.String()
+
+	httputil.WriteJSON(rw, healthState{
+		Healthy:      &h.healthy,
+		Ready:        &h.ready,
+		Delay:        &delay,
+		CheckTargets: &h.checkTargets,
+	}, http.StatusOK)
+}
+
+// setState updates the health state with the values specified in the request body, the other ones being left
+// untouched.
+func (h *health) setState(rw http.ResponseWriter, r *http.Request) {
+	var (
+		state healthState
+		delay time.Duration
+	)
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := json.Unmarshal(data, &state); err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if state.Delay != nil {
+		if delay, err = time.ParseDuration(*state.Delay); err != nil || delay < 0 {
+			http.Error(rw, "Invalid request body: invalid delay", http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.Lock()
+	defer h.Unlock()
+
+	var changes []string
+
+	if state.Healthy != nil {
+		h.healthy = *state.Healthy
+		changes = append(changes, fmt.Sprintf("healthy=%t", h.healthy))
+	}
+
+	if state.Ready != nil {
+		h.ready = *state.Ready
+		changes = append(changes, fmt.Sprintf("ready=%t", h.ready))
+	}
+
+	if state.Delay != nil {
+		h.delay = delay
+		changes = append(changes, fmt.Sprintf("delay=%s", h.delay))
+	}
+
+	if state.CheckTargets != nil {
+		h.checkTargets = *state.CheckTargets
+		changes = append(changes, fmt.Sprintf("check_targets=%t", h.checkTargets))
+	}
+
+	log.Info("health state updated: %s", strings.Join(changes, ", "))
+
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// instrumentation holds the middleware instrumenting the requests processing. Metrics and tracing relying on
+// process-wide registries, the instrumentation is shared by all the services running in the process.
+type instrumentation struct {
+	metrics   *metricsMiddleware
+	tracing   *tracing
+	accessLog *accessLog
+}
+
+// instrumentationSettings is a validated instrumentation configuration, ready to be applied.
+type instrumentationSettings struct {
+	metrics         *metricsMiddlewareConfig
+	tracing         configTracing
+	spanExporters   []spanExporter
+	accessLogFormat string
+	accessLogOutput io.WriteCloser
+}
+
+// newInstrumentation returns a new instrumentation configured according to config. If serviceTag is true, the
+// requests metrics are tagged with the name of the service handling them.
+func newInstrumentation(config *configTopology, serviceTag bool) (*instrumentation, error) {
+	var (
+		i   = instrumentation{tracing: newTracing(), accessLog: newAccessLog()}
+		err error
+	)
+
+	i.metrics, err = newMetricsMiddleware(newMetricsMiddlewareConfig(&config.Metrics, serviceTag))
+	if err != nil {
+		return nil, fmt.Errorf("metrics middleware init error: %s", err)
+	}
+
+	settings, err := i.prepare(config)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := i.apply(settings); err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// prepare checks the metrics, tracing and access log configuration, returning the settings to apply.
+func (i *instrumentation) prepare(config *configTopology) (*instrumentationSettings, error) {
+	var (
+		settings = instrumentationSettings{
+			metrics:         newMetricsMiddlewareConfig(&config.Metrics, i.metrics.serviceTag),
+			tracing:         config.Tracing,
+			accessLogFormat: config.AccessLog.Format,
+		}
+		err error
+	)
+
+	if err := i.metrics.checkConfig(settings.metrics); err != nil {
+		return nil, fmt.Errorf("invalid metrics configuration: %s", err)
+	}
+
+	if err := checkTracingConfig(&config.Tracing); err != nil {
+		return nil, fmt.Errorf("invalid tracing configuration: %s", err)
+	}
+
+	if err := checkAccessLogConfig(&config.AccessLog); err != nil {
+		return nil, fmt.Errorf("invalid access log configuration: %s", err)
+	}
+
+	if settings.spanExporters, err = newSpanExporters(&config.Tracing); err != nil {
+		return nil, fmt.Errorf("invalid tracing configuration: %s", err)
+	}
+
+	if settings.accessLogOutput, err = openAccessLogOutput(&config.AccessLog); err != nil {
+		closeSpanExporters(settings.spanExporters)
+		return nil, fmt.Errorf("invalid access log configuration: %s", err)
+	}
+
+	return &settings, nil
+}
+
+// apply replaces the current instrumentation settings by settings.
+func (i *instrumentation) apply(settings *instrumentationSettings) error {
+	if err := i.metrics.configure(settings.metrics); err != nil {
+		settings.discard()
+		return fmt.Errorf("metrics middleware error: %s", err)
+	}
+
+	i.tracing.configure(settings.tracing.SamplingRate, settings.spanExporters)
+	i.accessLog.configure(settings.accessLogFormat, settings.accessLogOutput)
+
+	return nil
+}
+
+// discard releases the resources held by settings not applied.
+func (s *instrumentationSettings) discard() {
+	closeSpanExporters(s.spanExporters)
+	s.accessLogOutput.Close()
+}
+
+// close flushes the spans pending export.
+func (i *instrumentation) close() {
+	i.tracing.close()
+}
@@ -0,0 +1,695 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	loadModelOpen   = "open"
+	loadModelClosed = "closed"
+
+	defaultLoadTimeout     = 10 * time.Second
+	defaultLoadMaxInFlight = 1000
+	defaultLoadProgress    = 10 * time.Second
+
+	// loadIdleStep is the maximum interval at which the open model scheduler checks the arrival rate, and at which
+	// the closed model adjusts the number of active users.
+	loadIdleStep = 100 * time.Millisecond
+)
+
+// loadPercentiles are the latency percentiles reported by the load generator.
+var loadPercentiles = []float64{50, 90, 95, 99, 99.9}
+
+type configLoadStage struct {
+	Duration time.Duration `yaml:"duration"`
+	Target   float64       `yaml:"target"`
+}
+
+type configLoadRequest struct {
+	Name    string            `yaml:"name"`
+	Method  string            `yaml:"method"`
+	Path    string            `yaml:"path"`
+	Headers map[string]string `yaml:"headers"`
+	Body    string            `yaml:"body"`
+	Weight  int               `yaml:"weight"`
+}
+
+// configLoad is the description of a load generator workload.
+type configLoad struct {
+	BaseURL     string              `yaml:"base_url"`
+	Model       string              `yaml:"model"`
+	Duration    time.Duration       `yaml:"duration"`
+	Rate        float64             `yaml:"rate"`
+	Users       int                 `yaml:"users"`
+	MaxInFlight int                 `yaml:"max_in_flight"`
+	ThinkTime   time.Duration       `yaml:"think_time"`
+	Timeout     time.Duration       `yaml:"timeout"`
+	Stages      []configLoadStage   `yaml:"stages"`
+	Requests    []configLoadRequest `yaml:"requests"`
+}
+
+// loadWorkload loads and checks the workload description file at path.
+func loadWorkload(path string) (*configLoad, error) {
+	var c = configLoad{
+		Model:       loadModelOpen,
+		MaxInFlight: defaultLoadMaxInFlight,
+		Timeout:     defaultLoadTimeout,
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal YAML data")
+	}
+
+	if c.Model != loadModelOpen && c.Model != loadModelClosed {
+		return nil, fmt.Errorf("unsupported model %q", c.Model)
+	}
+
+	if c.BaseURL == "" {
+		return nil, fmt.Errorf("base URL not specified")
+	}
+
+	if c.MaxInFlight <= 0 || c.Timeout <= 0 || c.Rate < 0 || c.Users < 0 || c.ThinkTime < 0 {
+		return nil, fmt.Errorf("invalid settings: values must be positive")
+	}
+
+	if len(c.Stages) == 0 {
+		if c.Duration <= 0 {
+			return nil, fmt.Errorf("either duration or stages must be specified")
+		}
+
+		target := c.Rate
+		if c.Model == loadModelClosed {
+			target = float64(c.Users)
+		}
+
+		if target == 0 {
+			if c.Model == loadModelClosed {
+				return nil, fmt.Errorf("users must be specified with duration")
+			}
+			return nil, fmt.Errorf("rate must be specified with duration")
+		}
+
+		// A constant workload is a stage starting at its target
+		c.Stages = []configLoadStage{{Target: target}, {Duration: c.Duration, Target: target}}
+	}
+
+	for _, s := range c.Stages {
+		if s.Duration < 0 || s.Target < 0 {
+			return nil, fmt.Errorf("invalid stage: values must be positive")
+		}
+	}
+
+	if len(c.Requests) == 0 {
+		return nil, fmt.Errorf("no requests specified")
+	}
+
+	for i := range c.Requests {
+		r := &c.Requests[i]
+
+		if r.Method == "" {
+			r.Method = "GET"
+		}
+
+		if r.Weight < 0 {
+			return nil, fmt.Errorf("invalid request %s %s: weight must be positive", r.Method, r.Path)
+		} else if r.Weight == 0 {
+			r.Weight = 1
+		}
+
+		if r.Name == "" {
+			r.Name = r.Method + " " + r.Path
+		}
+
+		if _, err := http.NewRequest(r.Method, c.BaseURL+r.Path, nil); err != nil {
+			return nil, fmt.Errorf("invalid request %s: %s", r.Name, err)
+		}
+	}
+
+	return &c, nil
+}
+
+// loadTarget returns the workload target (i.e. arrival rate or number of users) at the time elapsed since the
+// beginning of the load, the stages targets being linearly ramped from the previous stage one. It returns false once
+// all the stages are completed.
+func (c *configLoad) loadTarget(elapsed time.Duration) (float64, bool) {
+	var (
+		start time.Duration
+		from  float64
+	)
+
+	for _, s := range c.Stages {
+		if elapsed < start+s.Duration {
+			return from + (s.Target-from)*float64(elapsed-start)/float64(s.Duration), true
+		}
+
+		start += s.Duration
+		from = s.Target
+	}
+
+	return 0, false
+}
+
+// loadSample is the result of a request performed by the load generator.
+type loadSample struct {
+	request     *configLoadRequest
+	latency     time.Duration
+	serviceTime time.Duration
+	status      int
+	err         error
+}
+
+// loadStats accumulates the samples of a set of requests.
+type loadStats struct {
+	latencies    []time.Duration
+	serviceTimes []time.Duration
+	statusCodes  map[int]int
+	errors       map[string]int
+	failures     int
+}
+
+func newLoadStats() *loadStats {
+	return &loadStats{
+		statusCodes: make(map[int]int),
+		errors:      make(map[string]int),
+	}
+}
+
+func (s *loadStats) add(sample *loadSample) {
+	s.latencies = append(s.latencies, sample.latency)
+	s.serviceTimes = append(s.serviceTimes, sample.serviceTime)
+
+	switch {
+	case sample.err != nil:
+		s.failures++
+		if isTimeout(sample.err) {
+			s.errors["timeout"]++
+		} else {
+			s.errors["error"]++
+		}
+
+	default:
+		s.statusCodes[sample.status]++
+		if sample.status >= 500 {
+			s.failures++
+		}
+	}
+}
+
+// addCorrection records the synthetic latencies of the requests that would have been sent during a response time
+// exceeding the expected interval between two requests of a user, compensating the coordinated omission of the closed
+// model (as the HdrHistogram recordValueWithExpectedInterval method does).
+func (s *loadStats) addCorrection(interval time.Duration) {
+	if interval <= 0 {
+		return
+	}
+
+	for _, latency := range s.latencies[:len(s.serviceTimes)] {
+		for l := latency - interval; l >= interval; l -= interval {
+			s.latencies = append(s.latencies, l)
+		}
+	}
+}
+
+// baselineServiceTime returns the median service time of the samples, i.e. the service time expected from the
+// service when it keeps up with the load.
+func (s *loadStats) baselineServiceTime() time.Duration {
+	if len(s.serviceTimes) == 0 {
+		return 0
+	}
+
+	values := append([]time.Duration(nil), s.serviceTimes...)
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	return values[len(values)/2]
+}
+
+// loadDistribution is a summary of a latency distribution, in seconds.
+type loadDistribution map[string]float64
+
+func newLoadDistribution(values []time.Duration) loadDistribution {
+	d := loadDistribution{}
+
+	if len(values) == 0 {
+		return d
+	}
+
+	sort.Slice(values, func(i, j int) bool { return values[i] < values[j] })
+
+	var sum time.Duration
+	for _, v := range values {
+		sum += v
+	}
+
+	d["min"] = values[0].Seconds()
+	d["mean"] = (sum / time.Duration(len(values))).Seconds()
+	d["max"] = values[len(values)-1].Seconds()
+
+	for _, p := range loadPercentiles {
+		// Nearest-rank percentile
+		rank := int(math.Ceil(p/100*float64(len(values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+
+		d[loadPercentileKey(p)] = values[rank].Seconds()
+	}
+
+	return d
+}
+
+// loadReportStats is the report of a set of requests.
+type loadReportStats struct {
+	Name        string           `json:"name,omitempty"`
+	Count       int              `json:"count"`
+	Failures    int              `json:"failures"`
+	Throughput  float64          `json:"throughput"`
+	StatusCodes map[string]int   `json:"status_codes"`
+	Errors      map[string]int   `json:"errors,omitempty"`
+	Latency     loadDistribution `json:"latency"`
+	ServiceTime loadDistribution `json:"service_time"`
+}
+
+func newLoadReportStats(name string, s *loadStats, duration time.Duration) *loadReportStats {
+	r := loadReportStats{
+		Name:        name,
+		Count:       len(s.serviceTimes),
+		Failures:    s.failures,
+		Throughput:  float64(len(s.serviceTimes)) / duration.Seconds(),
+		StatusCodes: make(map[string]int, len(s.statusCodes)),
+		Errors:      s.errors,
+		Latency:     newLoadDistribution(s.latencies),
+		ServiceTime: newLoadDistribution(s.serviceTimes),
+	}
+
+	for code, n := range s.statusCodes {
+		r.StatusCodes[strconv.Itoa(code)] = n
+	}
+
+	return &r
+}
+
+// loadReport is the report of a load generator run.
+type loadReport struct {
+	BaseURL   string             `json:"base_url"`
+	Model     string             `json:"model"`
+	StartedAt time.Time          `json:"started_at"`
+	Duration  float64            `json:"duration"`
+	Total     *loadReportStats   `json:"total"`
+	Requests  []*loadReportStats `json:"requests"`
+}
+
+// loadGenerator drives a workload against a HTTP service.
+type loadGenerator struct {
+	config   *configLoad
+	client   *http.Client
+	weights  int
+	samples  chan *loadSample
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newLoadGenerator(config *configLoad) *loadGenerator {
+	g := loadGenerator{
+		config:   config,
+		samples:  make(chan *loadSample, config.MaxInFlight),
+		inFlight: make(chan struct{}, config.MaxInFlight),
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = config.MaxInFlight
+	g.client = &http.Client{Transport: transport, Timeout: config.Timeout}
+
+	for _, r := range config.Requests {
+		g.weights += r.Weight
+	}
+
+	return &g
+}
+
+// pick returns a request of the workload mix, randomly selected according to the requests weights.
+func (g *loadGenerator) pick() *configLoadRequest {
+	n := rand.Intn(g.weights)
+
+	for i := range g.config.Requests {
+		if n -= g.config.Requests[i].Weight; n < 0 {
+			return &g.config.Requests[i]
+		}
+	}
+
+	return &g.config.Requests[len(g.config.Requests)-1]
+}
+
+// do performs the request r, which was intended to be sent at the time intended.
+func (g *loadGenerator) do(r *configLoadRequest, intended time.Time) *loadSample {
+	var (
+		sample = loadSample{request: r}
+		body   io.Reader
+	)
+
+	if r.Body != "" {
+		body = strings.NewReader(r.Body)
+	}
+
+	req, err := http.NewRequest(r.Method, g.config.BaseURL+r.Path, body)
+	if err != nil {
+		sample.err = err
+		return &sample
+	}
+
+	for k, v := range r.Headers {
+		req.Header.Set(k, v)
+	}
+
+	start := time.Now()
+
+	res, err := g.client.Do(req)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		sample.status = res.StatusCode
+	}
+
+	sample.err = err
+	sample.serviceTime = time.Since(start)
+	sample.latency = time.Since(intended)
+
+	return &sample
+}
+
+// runOpen drives the open model workload: requests are sent at the workload arrival rate regardless of the
+// responses, their latency being measured from the time they were intended to be sent – so that the time spent
+// waiting for an in-flight slot when the service can't keep up is accounted for.
+func (g *loadGenerator) runOpen(start time.Time) {
+	var (
+		next = start
+
+		// accrued is the fraction of the next arrival accumulated over the steps the rate was too low to schedule it
+		accrued float64
+	)
+
+	for {
+		rate, ok := g.config.loadTarget(next.Sub(start))
+		if !ok {
+			return
+		}
+
+		// The arrival rate varying during ramps, it is integrated over steps of at most loadIdleStep: scheduling the
+		// next arrival from a rate close to zero at the beginning of a ramp would skip most of it.
+		if rate <= 0 || (1-accrued)/rate > loadIdleStep.Seconds() {
+			accrued += rate * loadIdleStep.Seconds()
+			next = next.Add(loadIdleStep)
+			time.Sleep(time.Until(next))
+			continue
+		}
+
+		next = next.Add(time.Duration((1 - accrued) / rate * float64(time.Second)))
+		accrued = 0
+
+		time.Sleep(time.Until(next))
+
+		g.inFlight <- struct{}{}
+		g.wg.Add(1)
+
+		go func(intended time.Time) {
+			defer func() { <-g.inFlight; g.wg.Done() }()
+			g.samples <- g.do(g.pick(), intended)
+		}(next)
+	}
+}
+
+// runClosed drives the closed model workload: the workload number of users send requests in a loop, waiting for
+// the think time between a response and their next request.
+func (g *loadGenerator) runClosed(start time.Time) {
+	var active []chan struct{}
+
+	for {
+		target, ok := g.config.loadTarget(time.Since(start))
+		if !ok {
+			break
+		}
+
+		users := int(target)
+
+		for len(active) < users {
+			stop := make(chan struct{})
+			active = append(active, stop)
+			g.wg.Add(1)
+			go g.user(stop)
+		}
+
+		for len(active) > users {
+			close(active[len(active)-1])
+			active = active[:len(active)-1]
+		}
+
+		time.Sleep(loadIdleStep)
+	}
+
+	for _, stop := range active {
+		close(stop)
+	}
+}
+
+func (g *loadGenerator) user(stop chan struct{}) {
+	defer g.wg.Done()
+
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		g.samples <- g.do(g.pick(), time.Now())
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(g.config.ThinkTime):
+		}
+	}
+}
+
+// run drives the workload, printing progress every progress interval, and returns its report.
+func (g *loadGenerator) run(progress time.Duration, output io.Writer) *loadReport {
+	var (
+		start    = time.Now()
+		total    = newLoadStats()
+		requests = make(map[string]*loadStats)
+		done     = make(chan struct{})
+		mutex    sync.Mutex
+	)
+
+	for _, r := range g.config.Requests {
+		requests[r.Name] = newLoadStats()
+	}
+
+	go func() {
+		for sample := range g.samples {
+			mutex.Lock()
+			for _, s := range []*loadStats{total, requests[sample.request.Name]} {
+				s.add(sample)
+			}
+			mutex.Unlock()
+		}
+		close(done)
+	}()
+
+	if progress > 0 {
+		ticker := time.NewTicker(progress)
+		defer ticker.Stop()
+
+		go func() {
+			var last, lastFailures int
+
+			for range ticker.C {
+				mutex.Lock()
+				count, failures := len(total.serviceTimes), total.failures
+				mutex.Unlock()
+
+				fmt.Fprintf(output, "[%s] %d requests, %.1f req/s, %d failures\n",
+					time.Since(start).Round(time.Second),
+					count,
+					float64(count-last)/progress.Seconds(),
+					failures-lastFailures,
+				)
+
+				last, lastFailures = count, failures
+			}
+		}()
+	}
+
+	if g.config.Model == loadModelOpen {
+		g.runOpen(start)
+	} else {
+		g.runClosed(start)
+	}
+
+	g.wg.Wait()
+	close(g.samples)
+	<-done
+
+	duration := time.Since(start)
+
+	if g.config.Model == loadModelClosed {
+		// The expected interval between two requests of a user is its cycle time: the think time, plus the time the
+		// service takes to respond when it keeps up with the load
+		interval := g.config.ThinkTime + total.baselineServiceTime()
+
+		total.addCorrection(interval)
+		for _, s := range requests {
+			s.addCorrection(interval)
+		}
+	}
+
+	report := loadReport{
+		BaseURL:   g.config.BaseURL,
+		Model:     g.config.Model,
+		StartedAt: start,
+		Duration:  duration.Seconds(),
+		Total:     newLoadReportStats("", total, duration),
+	}
+
+	for _, r := range g.config.Requests {
+		if _, ok := requests[r.Name]; !ok {
+			continue
+		}
+
+		report.Requests = append(report.Requests, newLoadReportStats(r.Name, requests[r.Name], duration))
+
+		// Requests sharing the same name are reported once
+		delete(requests, r.Name)
+	}
+
+	return &report
+}
+
+// print writes the report summary to w.
+func (r *loadReport) print(w io.Writer) {
+	fmt.Fprintf(w, "\n%s model, %s, %.1fs\n\n", r.Model, r.BaseURL, r.Duration)
+
+	fmt.Fprintf(w, "%-30s %8s %8s %9s", "REQUEST", "COUNT", "FAILURES", "RATE")
+	for _, p := range loadPercentiles {
+		fmt.Fprintf(w, " %9s", "P"+strconv.FormatFloat(p, 'f', -1, 64))
+	}
+	fmt.Fprintf(w, " %9s\n", "MAX")
+
+	for _, s := range append(r.Requests, r.Total) {
+		name := s.Name
+		if name == "" {
+			name = "TOTAL"
+		}
+
+		fmt.Fprintf(w, "%-30s %8d %8d %9.1f", name, s.Count, s.Failures, s.Throughput)
+		for _, p := range loadPercentiles {
+			fmt.Fprintf(w, " %9s", loadDuration(s.Latency[loadPercentileKey(p)]))
+		}
+		fmt.Fprintf(w, " %9s\n", loadDuration(s.Latency["max"]))
+	}
+
+	codes := make([]string, 0, len(r.Total.StatusCodes))
+	for code, n := range r.Total.StatusCodes {
+		codes = append(codes, fmt.Sprintf("%s: %d", code, n))
+	}
+	sort.Strings(codes)
+
+	fmt.Fprintf(w, "\nStatus codes: %s\n", strings.Join(codes, ", "))
+
+	if len(r.Total.Errors) > 0 {
+		errors := make([]string, 0, len(r.Total.Errors))
+		for err, n := range r.Total.Errors {
+			errors = append(errors, fmt.Sprintf("%s: %d", err, n))
+		}
+		sort.Strings(errors)
+
+		fmt.Fprintf(w, "Errors: %s\n", strings.Join(errors, ", "))
+	}
+}
+
+// loadPercentileKey returns the key of the percentile p in a latency distribution summary (e.g. "p999" for 99.9).
+func loadPercentileKey(p float64) string {
+	return "p" + strings.Replace(strconv.FormatFloat(p, 'f', -1, 64), ".", "", 1)
+}
+
+func loadDuration(seconds float64) string {
+	d := time.Duration(seconds * float64(time.Second))
+
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond).String()
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond).String()
+	}
+
+	return d.Round(time.Microsecond).String()
+}
+
+// runLoad is the "load" subcommand, driving the workload described in the file given as argument.
+func runLoad(args []string) {
+	var (
+		flags          = flag.NewFlagSet("load", flag.ExitOnError)
+		flagBaseURL    string
+		flagProgress   time.Duration
+		flagReportPath string
+	)
+
+	flags.StringVar(&flagBaseURL, "base-url", "", "target service base URL, overriding the workload one")
+	flags.DurationVar(&flagProgress, "progress-interval", defaultLoadProgress, "progress reporting interval (0 to disable)")
+	flags.StringVar(&flagReportPath, "report", "", "path to the JSON report file to write")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s load [options] <workload file>\n\nOptions:\n", path.Base(os.Args[0]))
+		flags.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(os.Stderr, "   -%s  %s (default: %q)\n", f.Name, f.Usage, f.DefValue)
+		})
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	config, err := loadWorkload(flags.Arg(0))
+	if err != nil {
+		dieOnError("unable to load workload: %s", err)
+	}
+
+	if flagBaseURL != "" {
+		config.BaseURL = flagBaseURL
+	}
+
+	report := newLoadGenerator(config).run(flagProgress, os.Stderr)
+	report.print(os.Stdout)
+
+	if flagReportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			dieOnError("unable to encode report: %s", err)
+		}
+
+		if err := ioutil.WriteFile(flagReportPath, data, 0644); err != nil {
+			dieOnError("unable to write report: %s", err)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLoadOpenModelRamp(t *testing.T) {
+	testCases := []struct {
+		name        string
+		target      float64
+		serviceTime time.Duration
+		maxInFlight int
+		count       int
+		queued      bool
+	}{
+		// Ramping from 0 to 20 req/s over 1s sends 10 requests, served without queueing
+		{"under capacity", 20, 5 * time.Millisecond, 10, 10, false},
+		// Ramping from 0 to 40 req/s over 1s sends 20 requests, the service only keeping up with 20 req/s: the
+		// requests waiting for an in-flight slot must be accounted for in their latency
+		{"over capacity", 40, 50 * time.Millisecond, 1, 20, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				time.Sleep(tc.serviceTime)
+			}))
+			defer s.Close()
+
+			g := newLoadGenerator(&configLoad{
+				BaseURL:     s.URL,
+				Model:       loadModelOpen,
+				MaxInFlight: tc.maxInFlight,
+				Timeout:     defaultLoadTimeout,
+				Stages:      []configLoadStage{{Duration: time.Second, Target: tc.target}},
+				Requests:    []configLoadRequest{{Name: "GET /", Method: "GET", Path: "/", Weight: 1}},
+			})
+
+			report := g.run(0, ioutil.Discard)
+
+			// The arrivals being scheduled at discrete times, the last one might fall after the end of the ramp
+			if report.Total.Count < tc.count-1 || report.Total.Count > tc.count {
+				t.Errorf("expected %d requests, got %d", tc.count, report.Total.Count)
+			}
+
+			latency, serviceTime := report.Total.Latency, report.Total.ServiceTime
+			if latency["min"] < serviceTime["min"] {
+				t.Errorf("latency %gs lower than service time %gs", latency["min"], serviceTime["min"])
+			}
+
+			// The last requests of the over capacity ramp wait for about 300ms before being sent
+			if queued := latency["max"]-serviceTime["max"] > 0.1; queued != tc.queued {
+				t.Errorf("expected queueing to be %t, got max latency %gs for max service time %gs", tc.queued,
+					latency["max"], serviceTime["max"])
+			}
+		})
+	}
+}
@@ -4,14 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"io"
-	"net/http"
+	"math/rand"
 	"os"
 	"os/signal"
 	"path"
 	"runtime"
 	"syscall"
-
-	"github.com/falzm/chaos"
+	"time"
 
 	"github.com/facette/logger"
 )
@@ -21,6 +20,8 @@ const (
 	defaultConfigPath = "flapi.yaml"
 	defaultBindAddr   = ":8000"
 	defaultLogLevel   = "info"
+
+	defaultConfigWatchInterval = 0
 )
 
 var (
@@ -31,22 +32,30 @@ var (
 	flagBindAddr      string
 	flagChaosBindAddr string
 	flagConfigPath    string
+	flagConfigWatch   time.Duration
 	flagHelp          bool
 	flagLogLevel      string
+	flagTopologyPath  string
 	flagVersion       bool
 
 	log *logger.Logger
 )
 
 func init() {
-	var err error
-
 	flag.BoolVar(&flagHelp, "help", false, "display this help and exit")
 	flag.BoolVar(&flagVersion, "version", false, "display version and exit")
 	flag.StringVar(&flagBindAddr, "bind-addr", defaultBindAddr, "HTTP server network [address]:port to bind to")
-	flag.StringVar(&flagChaosBindAddr, "chaos-bind-addr", chaos.DefaultBindAddr, "chaos management HTTP server network [address]:port to bind to")
+	flag.StringVar(&flagChaosBindAddr, "chaos-bind-addr", defaultChaosBindAddr, "chaos management HTTP server network [address]:port to bind to")
 	flag.StringVar(&flagConfigPath, "config", defaultConfigPath, "path to configuration file")
+	flag.DurationVar(&flagConfigWatch, "config-watch-interval", defaultConfigWatchInterval, "configuration file changes polling interval (0 to disable)")
 	flag.StringVar(&flagLogLevel, "log-level", defaultLogLevel, "logging level")
+	flag.StringVar(&flagTopologyPath, "topology", "", "path to topology file running multiple services (overrides -config, -bind-addr and -chaos-bind-addr)")
+}
+
+func main() {
+	var err error
+
+	// Flags are parsed here rather than in init, which would fail when running the package tests
 	flag.Parse()
 
 	if log, err = logger.NewLogger(logger.FileConfig{Level: flagLogLevel}); err != nil {
@@ -56,9 +65,9 @@ func init() {
 	if hostname, err = os.Hostname(); err != nil {
 		dieOnError("unable to get system hostname: %s", err)
 	}
-}
 
-func main() {
+	rand.Seed(time.Now().UnixNano())
+
 	if flagHelp {
 		printUsage(os.Stdout)
 		os.Exit(0)
@@ -67,51 +76,125 @@ func main() {
 		os.Exit(0)
 	}
 
-	config, err := loadConfig(flagConfigPath)
+	if flag.NArg() > 0 {
+		switch flag.Arg(0) {
+		case "load":
+			runLoad(flag.Args()[1:])
+			os.Exit(0)
+
+		case "generate":
+			runGenerate(flag.Args()[1:])
+			os.Exit(0)
+
+		default:
+			dieOnError("unknown command %q", flag.Arg(0))
+		}
+	}
+
+	config, err := loadTopologyConfig()
 	if err != nil {
 		dieOnError("unable to load configuration: %s", err)
 	}
 
-	service, err := newService(flagBindAddr, config)
+	topology, err := newTopology(config)
 	if err != nil {
 		dieOnError("unable to create service: %s", err)
 	}
 
 	// Handle service signals
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGHUP)
 
 	go func() {
 		for sig := range sigChan {
 			switch sig {
 			case syscall.SIGINT, syscall.SIGQUIT, syscall.SIGTERM:
-				service.shutdown()
+				topology.shutdown()
+
+			case syscall.SIGHUP:
+				reloadConfig(topology)
 			}
 		}
 	}()
 
-	log.Notice("starting")
+	if flagConfigWatch > 0 {
+		path := flagConfigPath
+		if flagTopologyPath != "" {
+			path = flagTopologyPath
+		}
+
+		// Configuration file changes are handled as SIGHUP signals, so that reloads are serialized
+		go watchConfig(path, flagConfigWatch, func() { sigChan <- syscall.SIGHUP })
+	}
 
-	log.Debug("listening on %s", flagBindAddr)
-	log.Debug("chaos management listening on %s", flagChaosBindAddr)
+	log.Notice("starting")
 
-	if err := service.run(); err != nil {
-		if err != http.ErrServerClosed {
-			log.Error("service: %s", err)
+	for _, s := range config.Services {
+		if s.Name != "" {
+			log.Debug("service %s listening on %s, chaos management listening on %s",
+				s.Name, s.BindAddr, s.ChaosBindAddr)
+			continue
 		}
+
+		log.Debug("listening on %s", s.BindAddr)
+		log.Debug("chaos management listening on %s", s.ChaosBindAddr)
 	}
 
+	if err := topology.run(); err != nil {
+		log.Error("service: %s", err)
+	}
+
+	// Flush the spans pending export
+	topology.instrumentation.close()
+
 	log.Notice("terminating")
 }
 
+// loadTopologyConfig loads the topology file if specified, otherwise the configuration file of the standalone
+// service.
+func loadTopologyConfig() (*configTopology, error) {
+	if flagTopologyPath != "" {
+		return loadTopology(flagTopologyPath)
+	}
+
+	config, err := loadConfig(flagConfigPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return newStandaloneTopology(config, flagBindAddr, flagChaosBindAddr)
+}
+
+// reloadConfig reloads the configuration or topology file and applies it to the services. If the new configuration
+// is invalid, the current one is kept.
+func reloadConfig(topology *topology) {
+	log.Info("reloading configuration")
+
+	config, err := loadTopologyConfig()
+	if err != nil {
+		log.Error("unable to reload configuration: %s", err)
+		return
+	}
+
+	if err := topology.configure(config); err != nil {
+		log.Error("unable to reload configuration: %s", err)
+		return
+	}
+
+	log.Notice("configuration reloaded")
+}
+
 func dieOnError(format string, a ...interface{}) {
 	fmt.Fprintf(os.Stderr, fmt.Sprintf("error: %s\n", format), a...)
 	os.Exit(1)
 }
 
 func printUsage(output io.Writer) {
-	fmt.Fprintf(output, "Usage: %s [options]", path.Base(os.Args[0]))
-	fmt.Fprint(output, "\n\nOptions:\n")
+	fmt.Fprintf(output, "Usage: %s [options] [command]", path.Base(os.Args[0]))
+	fmt.Fprint(output, "\n\nCommands:\n")
+	fmt.Fprint(output, "   load      drive a HTTP workload against a service (see \"load -help\")\n")
+	fmt.Fprint(output, "   generate  generate the Kubernetes or Docker Compose manifests of a topology (see \"generate -help\")\n")
+	fmt.Fprint(output, "\nOptions:\n")
 
 	flag.VisitAll(func(f *flag.Flag) {
 		fmt.Fprintf(output, "   -%s  %s (default: %q)\n", f.Name, f.Usage, f.DefValue)
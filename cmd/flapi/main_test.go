@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/facette/logger"
+)
+
+func TestMain(m *testing.M) {
+	var err error
+
+	if log, err = logger.NewLogger(logger.FileConfig{Level: "error"}); err != nil {
+		fmt.Fprintf(os.Stderr, "unable to initialize logger: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
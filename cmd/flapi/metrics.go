@@ -1,65 +1,181 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"os"
+	"reflect"
 	"strconv"
+	"sync"
 	"time"
 
+	prom "github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/urfave/negroni"
-	"go.opencensus.io/exporter/prometheus"
 	"go.opencensus.io/stats"
 	"go.opencensus.io/tag"
 )
 
+const (
+	metricsTagMethod      = "method"
+	metricsTagPath        = "path"
+	metricsTagStatus      = "status"
+	metricsTagStatusClass = "status_class"
+
+	// metricsTagService is the tag set to the name of the service handling the request when running a topology.
+	metricsTagService = "service"
+)
+
+var defaultMetricsTags = []string{metricsTagMethod, metricsTagPath, metricsTagStatus}
+
 type metricsMiddlewareConfig struct {
 	service           string
 	reqLatencyBuckets []float64
+	sizeBuckets       []float64
+	tags              []string
+	serviceTag        bool
+}
+
+func newMetricsMiddlewareConfig(config *configMetrics, serviceTag bool) *metricsMiddlewareConfig {
+	return &metricsMiddlewareConfig{
+		service:           "flapi",
+		reqLatencyBuckets: config.LatencyHistogramBuckets,
+		sizeBuckets:       config.SizeHistogramBuckets,
+		tags:              config.Tags,
+		serviceTag:        serviceTag,
+	}
 }
 
 type metricsMiddleware struct {
-	exporter   *prometheus.Exporter
-	reqLatency *stats.MeasureFloat64
-	tags       map[string]tag.Key
+	service         string
+	exporter        *viewsExporter
+	registry        *prom.Registry
+	handler         http.Handler
+	reqLatency      *stats.MeasureFloat64
+	reqSize         *stats.MeasureInt64
+	resSize         *stats.MeasureInt64
+	targetLatency   *stats.MeasureFloat64
+	targetErrors    *stats.MeasureInt64
+	chaosInjections *stats.MeasureInt64
+	inFlight        *prom.GaugeVec
+	breakers        *circuitBreakerCollector
+	tags            map[string]tag.Key
+	serviceTag      bool
+
+	views  []*stats.View
+	config *metricsMiddlewareConfig
+	sync.Mutex
 }
 
 func newMetricsMiddleware(config *metricsMiddlewareConfig) (*metricsMiddleware, error) {
 	var (
 		err error
 		mw  = metricsMiddleware{
-			tags: map[string]tag.Key{},
+			service:    config.service,
+			registry:   prom.NewRegistry(),
+			tags:       map[string]tag.Key{},
+			serviceTag: config.serviceTag,
 		}
 	)
 
-	if mw.exporter, err = prometheus.NewExporter(prometheus.Options{Namespace: config.service}); err != nil {
-		return nil, fmt.Errorf("unable to init Prometheus exporter: %s", err)
-	}
+	// The OpenCensus views are exported to the same Prometheus registry as the metrics not supported by OpenCensus
+	// (e.g. gauges), so that all the metrics are served from a single registry.
+	mw.exporter = newViewsExporter(config.service)
 	stats.RegisterExporter(mw.exporter)
 
+	mw.handler = promhttp.HandlerFor(mw.registry, promhttp.HandlerOpts{})
+
 	if mw.reqLatency, err = stats.NewMeasureFloat64("flapi/measure/http_request_latency",
 		"HTTP requests processing latency in seconds",
 		"second"); err != nil {
 		return nil, fmt.Errorf("unable to create http_request_latency measure: %s", err)
 	}
 
-	mw.tags["method"], _ = tag.NewKey("method")
-	mw.tags["path"], _ = tag.NewKey("path")
-	mw.tags["status"], _ = tag.NewKey("status")
+	if mw.reqSize, err = stats.NewMeasureInt64("flapi/measure/http_request_size",
+		"HTTP requests body size in bytes",
+		"byte"); err != nil {
+		return nil, fmt.Errorf("unable to create http_request_size measure: %s", err)
+	}
 
-	reqLatencyView, err := stats.NewView(
-		"http_request_latency",
-		"HTTP requests processing latency in seconds",
-		[]tag.Key{mw.tags["method"], mw.tags["path"], mw.tags["status"]},
-		mw.reqLatency,
-		stats.DistributionAggregation(config.reqLatencyBuckets),
-		stats.Cumulative{},
-	)
-	if err != nil {
-		return nil, fmt.Errorf("unable to create http_request_latency view: %s", err)
+	if mw.resSize, err = stats.NewMeasureInt64("flapi/measure/http_response_size",
+		"HTTP responses body size in bytes",
+		"byte"); err != nil {
+		return nil, fmt.Errorf("unable to create http_response_size measure: %s", err)
+	}
+
+	if mw.targetLatency, err = stats.NewMeasureFloat64("flapi/measure/chain_target_request_latency",
+		"Chain targets requests latency in seconds",
+		"second"); err != nil {
+		return nil, fmt.Errorf("unable to create chain_target_request_latency measure: %s", err)
+	}
+
+	if mw.targetErrors, err = stats.NewMeasureInt64("flapi/measure/chain_target_errors",
+		"Chain targets requests errors",
+		"1"); err != nil {
+		return nil, fmt.Errorf("unable to create chain_target_errors measure: %s", err)
+	}
+
+	if mw.chaosInjections, err = stats.NewMeasureInt64("flapi/measure/chaos_injections",
+		"Chaos injections",
+		"1"); err != nil {
+		return nil, fmt.Errorf("unable to create chaos_injections measure: %s", err)
 	}
 
-	if err := reqLatencyView.Subscribe(); err != nil {
-		return nil, fmt.Errorf("unable to subscribe to http_request_latency view: %s", err)
+	for _, k := range []string{
+		metricsTagMethod,
+		metricsTagPath,
+		metricsTagStatus,
+		metricsTagStatusClass,
+		"route",
+		"target_method",
+		"target_url",
+		"reason",
+		"type",
+		"direction",
+		metricsTagService,
+	} {
+		mw.tags[k], _ = tag.NewKey(k)
+	}
+
+	// The Prometheus metrics labels cannot be changed once registered, the service tag setting is fixed at startup
+	var serviceLabels []string
+	if config.serviceTag {
+		serviceLabels = []string{metricsTagService}
+	}
+
+	mw.inFlight = prom.NewGaugeVec(prom.GaugeOpts{
+		Namespace: config.service,
+		Name:      "http_requests_in_flight",
+		Help:      "Number of HTTP requests being processed",
+	}, serviceLabels)
+
+	mw.breakers = &circuitBreakerCollector{
+		desc: prom.NewDesc(
+			config.service+"_chain_target_circuit_breaker_state",
+			"Chain target circuit breaker state (0: closed, 1: half-open, 2: open)",
+			append([]string{"method", "route", "target_method", "target_url"}, serviceLabels...),
+			nil,
+		),
+	}
+
+	// The views exporter is registered once configured, since the registry checks the collectors descriptors at
+	// registration
+	if err := mw.configure(config); err != nil {
+		return nil, err
+	}
+
+	for _, c := range []prom.Collector{
+		mw.exporter,
+		mw.inFlight,
+		mw.breakers,
+		prom.NewGoCollector(),
+		prom.NewProcessCollector(os.Getpid(), ""),
+	} {
+		if err := mw.registry.Register(c); err != nil {
+			return nil, fmt.Errorf("unable to register collector: %s", err)
+		}
 	}
 
 	stats.SetReportingPeriod(1 * time.Second)
@@ -68,25 +184,482 @@ func newMetricsMiddleware(config *metricsMiddlewareConfig) (*metricsMiddleware,
 }
 
 func (mw *metricsMiddleware) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
-	start := time.Now()
+	var (
+		start         = time.Now()
+		ctx           = r.Context()
+		serviceLabels []string
+		err           error
+	)
+
+	// The service tag is set in the request context, so that the chain targets requests and chaos injections metrics
+	// carry it as well
+	if name, ok := ctx.Value(serviceContextKey).(string); ok && mw.serviceTag {
+		if ctx, err = tag.New(ctx, tag.Insert(mw.tags[metricsTagService], name)); err != nil {
+			ctx = r.Context()
+		}
+		serviceLabels = []string{name}
+	}
 
-	next(rw, r)
+	inFlight := mw.inFlight.WithLabelValues(serviceLabels...)
+	inFlight.Inc()
+	defer inFlight.Dec()
+
+	next(rw, r.WithContext(context.WithValue(ctx, metricsContextKey, mw)))
 
 	res := rw.(negroni.ResponseWriter)
 
-	// TODO: configurable tags
-	ctx, err := tag.New(r.Context(),
-		tag.Insert(mw.tags["method"], r.Method),
-		tag.Insert(mw.tags["path"], r.URL.Path),
-		tag.Insert(mw.tags["status"], strconv.Itoa(res.Status())),
+	// All the supported tags are set, the views retaining the configured ones only
+	ctx, err = tag.New(ctx,
+		tag.Insert(mw.tags[metricsTagMethod], r.Method),
+		tag.Insert(mw.tags[metricsTagPath], routeTag(r.Context())),
+		tag.Insert(mw.tags[metricsTagStatus], strconv.Itoa(res.Status())),
+		tag.Insert(mw.tags[metricsTagStatusClass], fmt.Sprintf("%dxx", res.Status()/100)),
+	)
+	if err != nil {
+		return
+	}
+
+	stats.Record(ctx,
+		mw.reqLatency.M(float64(time.Since(start).Nanoseconds())/1000000000),
+		mw.resSize.M(int64(res.Size())),
+	)
+
+	if r.ContentLength >= 0 {
+		stats.Record(ctx, mw.reqSize.M(r.ContentLength))
+	}
+}
+
+// recordTargetAttempt records the latency and outcome of a chain target request attempt.
+func (mw *metricsMiddleware) recordTargetAttempt(ctx context.Context, t *endpointTarget, attempt *targetAttempt,
+	latency time.Duration) {
+	var reason string
+
+	route := routeTag(ctx)
+	status := strconv.Itoa(attempt.code)
+
+	switch {
+	case attempt.rejected:
+		reason = "circuit_open"
+	case isTimeout(attempt.err):
+		reason, status = "timeout", "error"
+	case attempt.err != nil:
+		reason, status = "error", "error"
+	case attempt.code >= 500:
+		reason = "status"
+	}
+
+	ctx, err := tag.New(ctx,
+		tag.Upsert(mw.tags["route"], route),
+		tag.Upsert(mw.tags["target_method"], t.method),
+		tag.Upsert(mw.tags["target_url"], t.rawURL),
+		tag.Upsert(mw.tags[metricsTagStatus], status),
+		tag.Upsert(mw.tags["reason"], reason),
+	)
+	if err != nil {
+		return
+	}
+
+	if !attempt.rejected {
+		stats.Record(ctx, mw.targetLatency.M(float64(latency.Nanoseconds())/1000000000))
+	}
+
+	if reason != "" {
+		stats.Record(ctx, mw.targetErrors.M(1))
+	}
+}
+
+// recordChaos records a chaos injection into a request, either inbound or outbound to the target path.
+func (mw *metricsMiddleware) recordChaos(ctx context.Context, injection, direction, path string) {
+	ctx, err := tag.New(ctx,
+		tag.Upsert(mw.tags["type"], injection),
+		tag.Upsert(mw.tags["direction"], direction),
+		tag.Upsert(mw.tags[metricsTagPath], path),
 	)
 	if err != nil {
 		return
 	}
 
-	stats.Record(ctx, mw.reqLatency.M(float64(time.Since(start).Nanoseconds())/1000000000))
+	stats.Record(ctx, mw.chaosInjections.M(1))
+}
+
+// isTimeout returns true if err is a timeout error.
+func isTimeout(err error) bool {
+	e, ok := err.(interface{ Timeout() bool })
+	return ok && e.Timeout()
+}
+
+// configure sets the histograms buckets and the HTTP requests metrics tags. Since the buckets of an OpenCensus view
+// cannot be modified, the views are replaced by new ones if the settings differ from the current ones: the values
+// previously recorded are lost.
+func (mw *metricsMiddleware) configure(config *metricsMiddlewareConfig) error {
+	mw.Lock()
+	defer mw.Unlock()
+
+	if mw.config != nil &&
+		reflect.DeepEqual(config.reqLatencyBuckets, mw.config.reqLatencyBuckets) &&
+		reflect.DeepEqual(config.sizeBuckets, mw.config.sizeBuckets) &&
+		reflect.DeepEqual(config.tags, mw.config.tags) {
+		return nil
+	}
+
+	if err := mw.checkConfig(config); err != nil {
+		return err
+	}
+
+	for _, v := range mw.views {
+		if err := v.Unsubscribe(); err != nil {
+			return fmt.Errorf("unable to unsubscribe from %s view: %s", v.Name(), err)
+		}
+
+		if err := stats.UnregisterView(v); err != nil {
+			return fmt.Errorf("unable to unregister %s view: %s", v.Name(), err)
+		}
+	}
+	mw.views = nil
+
+	httpTags := make([]tag.Key, len(config.tags))
+	for i, t := range config.tags {
+		httpTags[i] = mw.tags[t]
+	}
+
+	targetTags := []tag.Key{mw.tags["route"], mw.tags["target_method"], mw.tags["target_url"]}
+	chaosTags := []tag.Key{mw.tags["type"], mw.tags["direction"], mw.tags[metricsTagPath]}
+
+	if config.serviceTag {
+		httpTags = append(httpTags, mw.tags[metricsTagService])
+		targetTags = append(targetTags, mw.tags[metricsTagService])
+		chaosTags = append(chaosTags, mw.tags[metricsTagService])
+	}
+
+	for _, v := range []struct {
+		name        string
+		description string
+		tags        []tag.Key
+		measure     stats.Measure
+		aggregation stats.Aggregation
+	}{
+		{
+			"http_request_latency",
+			"HTTP requests processing latency in seconds",
+			httpTags,
+			mw.reqLatency,
+			stats.DistributionAggregation(config.reqLatencyBuckets),
+		},
+		{
+			"http_request_size",
+			"HTTP requests body size in bytes",
+			httpTags,
+			mw.reqSize,
+			stats.DistributionAggregation(config.sizeBuckets),
+		},
+		{
+			"http_response_size",
+			"HTTP responses body size in bytes",
+			httpTags,
+			mw.resSize,
+			stats.DistributionAggregation(config.sizeBuckets),
+		},
+		{
+			"chain_target_request_latency",
+			"Chain targets requests latency in seconds",
+			append(targetTags[:len(targetTags):len(targetTags)], mw.tags[metricsTagStatus]),
+			mw.targetLatency,
+			stats.DistributionAggregation(config.reqLatencyBuckets),
+		},
+		{
+			"chain_target_errors_total",
+			"Chain targets requests errors (reason: error, timeout, status, circuit_open)",
+			append(targetTags[:len(targetTags):len(targetTags)], mw.tags["reason"]),
+			mw.targetErrors,
+			stats.CountAggregation{},
+		},
+		{
+			"chaos_injections_total",
+			"Chaos injections (type: delay, error, fault; direction: inbound, outbound)",
+			chaosTags,
+			mw.chaosInjections,
+			stats.CountAggregation{},
+		},
+	} {
+		view, err := stats.NewView(v.name, v.description, v.tags, v.measure, v.aggregation, stats.Cumulative{})
+		if err != nil {
+			return fmt.Errorf("unable to create %s view: %s", v.name, err)
+		}
+
+		if err := view.Subscribe(); err != nil {
+			return fmt.Errorf("unable to subscribe to %s view: %s", v.name, err)
+		}
+
+		mw.views = append(mw.views, view)
+	}
+
+	mw.exporter.setViews(mw.views)
+
+	if mw.config != nil {
+		log.Info("updated metrics settings: latency buckets %v, size buckets %v, tags %v",
+			config.reqLatencyBuckets, config.sizeBuckets, config.tags)
+	}
+
+	mw.config = config
+
+	return nil
+}
+
+// checkConfig checks that the metrics settings are valid and can be applied to the running middleware.
+func (mw *metricsMiddleware) checkConfig(config *metricsMiddlewareConfig) error {
+	if err := checkMetricsConfig(config.reqLatencyBuckets, config.sizeBuckets, config.tags); err != nil {
+		return err
+	}
+
+	// The Prometheus registry checks the views exporter descriptors, and thus the metrics labels, at registration only
+	if mw.config != nil && !reflect.DeepEqual(config.tags, mw.config.tags) {
+		return fmt.Errorf("tags cannot be changed without restarting")
+	}
+
+	return nil
+}
+
+// checkMetricsConfig checks that the metrics settings are valid.
+func checkMetricsConfig(latencyBuckets, sizeBuckets []float64, tags []string) error {
+	if err := checkHistogramBuckets(latencyBuckets); err != nil {
+		return fmt.Errorf("latency histogram buckets: %s", err)
+	}
+
+	if err := checkHistogramBuckets(sizeBuckets); err != nil {
+		return fmt.Errorf("size histogram buckets: %s", err)
+	}
+
+	seen := make(map[string]bool)
+	for _, t := range tags {
+		switch t {
+		case metricsTagMethod, metricsTagPath, metricsTagStatus, metricsTagStatusClass:
+		default:
+			return fmt.Errorf("unsupported tag %q", t)
+		}
+
+		if seen[t] {
+			return fmt.Errorf("duplicate tag %q", t)
+		}
+		seen[t] = true
+	}
+
+	return nil
+}
+
+// checkHistogramBuckets checks that histogram buckets are valid, i.e. positive and strictly increasing.
+func checkHistogramBuckets(buckets []float64) error {
+	if len(buckets) == 0 {
+		return fmt.Errorf("buckets not specified")
+	}
+
+	for i, b := range buckets {
+		if b <= 0 || (i > 0 && b <= buckets[i-1]) {
+			return fmt.Errorf("buckets must be positive and strictly increasing")
+		}
+	}
+
+	return nil
+}
+
+// registerCircuitBreakers exports the state of the circuit breakers of the chain targets of the endpoints returned
+// by the endpoints function, which belong to the service named service.
+func (mw *metricsMiddleware) registerCircuitBreakers(service string, endpoints func() []*endpoint) {
+	mw.breakers.Lock()
+	mw.breakers.sources = append(mw.breakers.sources, circuitBreakerSource{service: service, endpoints: endpoints})
+	mw.breakers.Unlock()
 }
 
 func (m *metricsMiddleware) HandleMetrics(rw http.ResponseWriter, r *http.Request) {
-	m.exporter.ServeHTTP(rw, r)
+	m.handler.ServeHTTP(rw, r)
+}
+
+// circuitBreakerCollector implements the prometheus.Collector interface, reporting the endpoints chain targets
+// circuit breakers state as a gauge.
+type circuitBreakerCollector struct {
+	desc    *prom.Desc
+	sources []circuitBreakerSource
+
+	sync.Mutex
+}
+
+// circuitBreakerSource returns the endpoints of a service, whose chain targets circuit breakers state is reported.
+type circuitBreakerSource struct {
+	service   string
+	endpoints func() []*endpoint
+}
+
+func (c *circuitBreakerCollector) Describe(ch chan<- *prom.Desc) {
+	ch <- c.desc
+}
+
+func (c *circuitBreakerCollector) Collect(ch chan<- prom.Metric) {
+	c.Lock()
+	sources := c.sources
+	c.Unlock()
+
+	for _, s := range sources {
+		for _, e := range s.endpoints() {
+			for _, t := range e.targets {
+				if t.breaker == nil {
+					continue
+				}
+
+				labels := []string{e.method, e.route, t.method, t.rawURL}
+				if s.service != "" {
+					labels = append(labels, s.service)
+				}
+
+				ch <- prom.MustNewConstMetric(c.desc, prom.GaugeValue, float64(t.breaker.currentState()),
+					labels...)
+			}
+		}
+	}
+}
+
+// viewsExporter implements both the OpenCensus stats.Exporter and the prometheus.Collector interfaces, exporting the
+// data of the OpenCensus views as Prometheus metrics.
+type viewsExporter struct {
+	namespace string
+	views     map[string]*stats.View
+	descs     map[string]*prom.Desc
+	data      map[string]*stats.ViewData
+
+	sync.Mutex
+}
+
+func newViewsExporter(namespace string) *viewsExporter {
+	return &viewsExporter{
+		namespace: namespace,
+		views:     make(map[string]*stats.View),
+		descs:     make(map[string]*prom.Desc),
+		data:      make(map[string]*stats.ViewData),
+	}
+}
+
+// setViews replaces the exported views by views, discarding the data of the previous ones.
+func (e *viewsExporter) setViews(views []*stats.View) {
+	e.Lock()
+	defer e.Unlock()
+
+	e.views = make(map[string]*stats.View, len(views))
+	e.descs = make(map[string]*prom.Desc, len(views))
+	e.data = make(map[string]*stats.ViewData, len(views))
+
+	for _, v := range views {
+		labels := make([]string, len(v.TagKeys()))
+		for i, k := range v.TagKeys() {
+			labels[i] = k.Name()
+		}
+
+		e.views[v.Name()] = v
+		e.descs[v.Name()] = prom.NewDesc(e.namespace+"_"+v.Name(), v.Description(), labels, nil)
+	}
+}
+
+// ExportView records the latest data of an exported view, the data of the views replaced meanwhile being ignored.
+func (e *viewsExporter) ExportView(vd *stats.ViewData) {
+	e.Lock()
+	defer e.Unlock()
+
+	if e.views[vd.View.Name()] == vd.View {
+		e.data[vd.View.Name()] = vd
+	}
+}
+
+func (e *viewsExporter) Describe(ch chan<- *prom.Desc) {
+	e.Lock()
+	defer e.Unlock()
+
+	for _, desc := range e.descs {
+		ch <- desc
+	}
+}
+
+func (e *viewsExporter) Collect(ch chan<- prom.Metric) {
+	e.Lock()
+	defer e.Unlock()
+
+	for name, vd := range e.data {
+		for _, row := range vd.Rows {
+			ch <- e.metric(e.descs[name], vd.View, row)
+		}
+	}
+}
+
+// metric returns the Prometheus metric of a view data row.
+func (e *viewsExporter) metric(desc *prom.Desc, view *stats.View, row *stats.Row) prom.Metric {
+	var (
+		metric prom.Metric
+		err    error
+	)
+
+	tags := make(map[tag.Key]string, len(row.Tags))
+	for _, t := range row.Tags {
+		tags[t.Key] = t.Value
+	}
+
+	labels := make([]string, len(view.TagKeys()))
+	for i, k := range view.TagKeys() {
+		labels[i] = tags[k]
+	}
+
+	switch data := row.Data.(type) {
+	case *stats.CountData:
+		metric, err = prom.NewConstMetric(desc, prom.CounterValue, float64(*data), labels...)
+
+	case *stats.DistributionData:
+		// Prometheus histograms buckets counts are cumulative, whereas OpenCensus reports the count of values
+		// falling in each bucket only
+		var (
+			bounds  = view.Aggregation().(stats.DistributionAggregation)
+			buckets = make(map[float64]uint64, len(bounds))
+			count   uint64
+		)
+
+		for i, b := range bounds {
+			count += uint64(data.CountPerBucket[i])
+			buckets[b] = count
+		}
+
+		metric, err = prom.NewConstHistogram(desc, uint64(data.Count), data.Sum(), buckets, labels...)
+
+	default:
+		err = fmt.Errorf("unsupported aggregation %T", row.Data)
+	}
+
+	if err != nil {
+		return prom.NewInvalidMetric(desc, err)
+	}
+
+	return metric
+}
+
+// bufferResponseWriter is a minimal http.ResponseWriter implementation buffering the response.
+type bufferResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+// statusCode returns the buffered response status code, defaulting to 200 if none has been written.
+func (rw *bufferResponseWriter) statusCode() int {
+	if rw.status == 0 {
+		return http.StatusOK
+	}
+
+	return rw.status
+}
+
+func (rw *bufferResponseWriter) Header() http.Header {
+	return rw.header
+}
+
+func (rw *bufferResponseWriter) Write(p []byte) (int, error) {
+	return rw.body.Write(p)
+}
+
+func (rw *bufferResponseWriter) WriteHeader(status int) {
+	if rw.status == 0 {
+		rw.status = status
+	}
 }
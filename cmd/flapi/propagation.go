@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// propagation defines how the inbound request headers and body are propagated to a chain target request.
+type propagation struct {
+	forwardHeaders []string
+	requestHeaders map[string]string
+	headerTmpls    headerTemplates
+	forwardBody    bool
+}
+
+// newPropagation returns the propagation rules of a chain target, the target rules extending the endpoint ones.
+func newPropagation(endpoint, target *configPropagation) (*propagation, error) {
+	var (
+		p = propagation{
+			requestHeaders: make(map[string]string),
+			forwardBody:    endpoint.ForwardBody || target.ForwardBody,
+		}
+		err error
+	)
+
+	forward := make(map[string]bool)
+	for _, h := range append(append([]string{}, endpoint.ForwardHeaders...), target.ForwardHeaders...) {
+		if h = http.CanonicalHeaderKey(strings.TrimSpace(h)); h == "" {
+			return nil, fmt.Errorf("invalid forwarded header name")
+		}
+		forward[h] = true
+	}
+	for h := range forward {
+		p.forwardHeaders = append(p.forwardHeaders, h)
+	}
+	sort.Strings(p.forwardHeaders)
+
+	for k, v := range endpoint.RequestHeaders {
+		p.requestHeaders[k] = v
+	}
+	for k, v := range target.RequestHeaders {
+		p.requestHeaders[k] = v
+	}
+
+	if p.headerTmpls, err = newHeaderTemplates(p.requestHeaders); err != nil {
+		return nil, fmt.Errorf("request headers: %s", err)
+	}
+
+	return &p, nil
+}
+
+// body returns the body of the target request, i.e. the inbound request body if it is forwarded.
+func (p *propagation) body(data *templateData) io.Reader {
+	if data == nil || !p.forwardBody || data.RawBody == "" {
+		return nil
+	}
+
+	return strings.NewReader(data.RawBody)
+}
+
+// apply sets the target request req headers from the inbound request data: the request ID is always propagated,
+// followed by the forwarded headers and the request headers rendered as templates.
+func (p *propagation) apply(req *http.Request, data *templateData) error {
+	if data == nil {
+		return nil
+	}
+
+	if id := data.Headers.Get(requestIDHeader); id != "" {
+		req.Header.Set(requestIDHeader, id)
+	}
+
+	if req.Body != nil {
+		if ct := data.Headers.Get("Content-Type"); ct != "" {
+			req.Header.Set("Content-Type", ct)
+		}
+	}
+
+	for _, h := range p.forwardHeaders {
+		if v, ok := data.Headers[h]; ok {
+			req.Header[h] = append([]string(nil), v...)
+		}
+	}
+
+	return p.headerTmpls.render(req.Header, data)
+}
+
+// requestID is a Negroni middleware setting a generated X-Request-Id header to the requests not having one, so that
+// requests can be followed across chained endpoints. The request ID is also returned in the response headers.
+func requestID(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = newUUID()
+		r.Header.Set(requestIDHeader, id)
+	}
+
+	rw.Header().Set(requestIDHeader, id)
+
+	next(rw, r)
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"strconv"
+	"sync"
+
+	"github.com/facette/httputil"
+	"github.com/gorilla/mux"
+)
+
+const (
+	resourceIDInt  = "int"
+	resourceIDUUID = "uuid"
+
+	defaultResourceIDField = "id"
+)
+
+// resource is an in-memory collection of JSON objects, exposed through CRUD routes.
+type resource struct {
+	idField  string
+	idType   string
+	pageSize int
+	seed     json.RawMessage
+	seedFile string
+
+	items  map[string]map[string]interface{}
+	order  []string
+	nextID int64
+
+	sync.RWMutex
+}
+
+func newResource(config *configResource) (*resource, error) {
+	r := resource{
+		idField:  config.IDField,
+		idType:   config.IDType,
+		pageSize: config.PageSize,
+		seedFile: config.SeedFile,
+		items:    make(map[string]map[string]interface{}),
+		nextID:   1,
+	}
+
+	if r.idField == "" {
+		r.idField = defaultResourceIDField
+	}
+
+	switch r.idType {
+	case "":
+		r.idType = resourceIDInt
+	case resourceIDInt, resourceIDUUID:
+	default:
+		return nil, fmt.Errorf("unsupported resource ID type %q", r.idType)
+	}
+
+	if r.pageSize < 0 {
+		return nil, fmt.Errorf("resource page size must be positive")
+	}
+
+	seed := make([]interface{}, len(config.Seed))
+	for i := range config.Seed {
+		seed[i] = normalizeYAML(config.Seed[i])
+	}
+
+	// The seed items being modified along with the collection, their initial JSON representation is kept for the
+	// endpoints listing
+	if len(seed) > 0 {
+		var err error
+
+		if r.seed, err = json.Marshal(seed); err != nil {
+			return nil, fmt.Errorf("invalid resource seed: %s", err)
+		}
+	}
+
+	if r.seedFile != "" {
+		var items []interface{}
+
+		data, err := ioutil.ReadFile(r.seedFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read resource seed file: %s", err)
+		}
+
+		if err := json.Unmarshal(data, &items); err != nil {
+			return nil, fmt.Errorf("invalid resource seed file: %s", err)
+		}
+
+		seed = append(seed, items...)
+	}
+
+	for i, v := range seed {
+		item, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid resource seed item #%d: not an object", i+1)
+		}
+
+		if _, err := r.create(item); err != nil {
+			return nil, fmt.Errorf("invalid resource seed item #%d: %s", i+1, err)
+		}
+	}
+
+	return &r, nil
+}
+
+// routes returns the CRUD routes of the resource collection exposed at route.
+func (r *resource) routes(route string) []endpointRoute {
+	itemRoute := path.Join(route, "{id}")
+
+	return []endpointRoute{
+		{method: "GET", route: route, handler: r.list},
+		{method: "POST", route: route, handler: r.post},
+		{method: "GET", route: itemRoute, handler: r.get},
+		{method: "PUT", route: itemRoute, handler: r.put},
+		{method: "PATCH", route: itemRoute, handler: r.patch},
+		{method: "DELETE", route: itemRoute, handler: r.delete},
+	}
+}
+
+// create adds item to the collection, generating its ID if it doesn't have one. The caller must hold the resource
+// lock once the resource is exposed.
+func (r *resource) create(item map[string]interface{}) (string, error) {
+	var id string
+
+	if v, ok := item[r.idField]; ok && v != nil {
+		id = fmt.Sprint(v)
+
+		if n, err := strconv.ParseInt(id, 10, 64); err == nil && n >= r.nextID {
+			r.nextID = n + 1
+		}
+	} else {
+		switch r.idType {
+		case resourceIDInt:
+			item[r.idField] = r.nextID
+			id = strconv.FormatInt(r.nextID, 10)
+			r.nextID++
+
+		case resourceIDUUID:
+			id = newUUID()
+			item[r.idField] = id
+		}
+	}
+
+	if _, ok := r.items[id]; ok {
+		return "", fmt.Errorf("duplicate item ID %q", id)
+	}
+
+	r.items[id] = item
+	r.order = append(r.order, id)
+
+	return id, nil
+}
+
+func (r *resource) list(rw http.ResponseWriter, req *http.Request) {
+	var err error
+
+	page, perPage := 1, r.pageSize
+
+	if v := req.URL.Query().Get("page"); v != "" {
+		if page, err = strconv.Atoi(v); err != nil || page < 1 {
+			http.Error(rw, "Invalid value for page parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	if v := req.URL.Query().Get("per_page"); v != "" {
+		if perPage, err = strconv.Atoi(v); err != nil || perPage < 1 {
+			http.Error(rw, "Invalid value for per_page parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
+	r.RLock()
+	defer r.RUnlock()
+
+	start, end := 0, len(r.order)
+	if perPage > 0 {
+		if start = (page - 1) * perPage; start > len(r.order) {
+			start = len(r.order)
+		}
+
+		if end = start + perPage; end > len(r.order) {
+			end = len(r.order)
+		}
+	}
+
+	items := make([]map[string]interface{}, 0, end-start)
+	for _, id := range r.order[start:end] {
+		items = append(items, r.items[id])
+	}
+
+	rw.Header().Set("X-Total-Count", strconv.Itoa(len(r.order)))
+	httputil.WriteJSON(rw, items, http.StatusOK)
+}
+
+func (r *resource) post(rw http.ResponseWriter, req *http.Request) {
+	item, ok := readResourceItem(rw, req)
+	if !ok {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	id, err := r.create(item)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	rw.Header().Set("Location", path.Join(req.URL.Path, id))
+	httputil.WriteJSON(rw, item, http.StatusCreated)
+}
+
+func (r *resource) get(rw http.ResponseWriter, req *http.Request) {
+	r.RLock()
+	defer r.RUnlock()
+
+	item, ok := r.items[mux.Vars(req)["id"]]
+	if !ok {
+		http.Error(rw, "No such item", http.StatusNotFound)
+		return
+	}
+
+	httputil.WriteJSON(rw, item, http.StatusOK)
+}
+
+func (r *resource) put(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	item, ok := readResourceItem(rw, req)
+	if !ok {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.items[id]; ok {
+		item[r.idField] = r.items[id][r.idField]
+		r.items[id] = item
+		httputil.WriteJSON(rw, item, http.StatusOK)
+		return
+	}
+
+	item[r.idField] = id
+	if n, err := strconv.ParseInt(id, 10, 64); err == nil {
+		item[r.idField] = n
+	}
+
+	if _, err := r.create(item); err != nil {
+		http.Error(rw, err.Error(), http.StatusConflict)
+		return
+	}
+
+	httputil.WriteJSON(rw, item, http.StatusCreated)
+}
+
+func (r *resource) patch(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	patch, ok := readResourceItem(rw, req)
+	if !ok {
+		return
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	item, ok := r.items[id]
+	if !ok {
+		http.Error(rw, "No such item", http.StatusNotFound)
+		return
+	}
+
+	for k, v := range patch {
+		if k != r.idField {
+			item[k] = v
+		}
+	}
+
+	httputil.WriteJSON(rw, item, http.StatusOK)
+}
+
+func (r *resource) delete(rw http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.items[id]; !ok {
+		http.Error(rw, "No such item", http.StatusNotFound)
+		return
+	}
+
+	delete(r.items, id)
+	for i := range r.order {
+		if r.order[i] == id {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (r *resource) MarshalJSON() ([]byte, error) {
+	jr := map[string]interface{}{
+		"id_field": r.idField,
+		"id_type":  r.idType,
+	}
+
+	if r.pageSize > 0 {
+		jr["page_size"] = r.pageSize
+	}
+
+	if r.seed != nil {
+		jr["seed"] = r.seed
+	}
+
+	if r.seedFile != "" {
+		jr["seed_file"] = r.seedFile
+	}
+
+	return json.Marshal(jr)
+}
+
+// readResourceItem decodes the JSON object from the request body. If the body is invalid, an error response is sent
+// and ok is false.
+func readResourceItem(rw http.ResponseWriter, req *http.Request) (item map[string]interface{}, ok bool) {
+	data, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("Invalid request body: %s", err), http.StatusBadRequest)
+		return nil, false
+	}
+
+	if err := json.Unmarshal(data, &item); err != nil || item == nil {
+		http.Error(rw, "Invalid request body: JSON object expected", http.StatusBadRequest)
+		return nil, false
+	}
+
+	return item, true
+}
+
+// normalizeYAML converts the maps decoded from YAML data to JSON-compatible maps with string keys.
+func normalizeYAML(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, val := range v {
+			m[fmt.Sprint(k)] = normalizeYAML(val)
+		}
+		return m
+
+	case []interface{}:
+		for i := range v {
+			v[i] = normalizeYAML(v[i])
+		}
+		return v
+	}
+
+	return v
+}
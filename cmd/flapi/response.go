@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	responsesWeighted = "weighted"
+	responsesSequence = "sequence"
+	responsesCycle    = "cycle"
+)
+
+// headerTemplates are headers whose values are rendered as templates.
+type headerTemplates map[string]*template.Template
+
+func newHeaderTemplates(headers map[string]string) (headerTemplates, error) {
+	var err error
+
+	tmpls := make(headerTemplates)
+	for k, v := range headers {
+		if tmpls[k], err = newResponseTemplate(k, v); err != nil {
+			return nil, fmt.Errorf("invalid header %s template: %s", k, err)
+		}
+	}
+
+	return tmpls, nil
+}
+
+// render sets the headers rendered with the request template data.
+func (h headerTemplates) render(header http.Header, data *templateData) error {
+	for k, tmpl := range h {
+		v, err := renderTemplate(tmpl, data)
+		if err != nil {
+			return err
+		}
+		header.Set(k, string(v))
+	}
+
+	return nil
+}
+
+// response is a local endpoint response definition.
+type response struct {
+	status      int
+	headers     map[string]string
+	headerTmpls headerTemplates
+	contentType string
+	body        string
+	bodyTmpl    *template.Template
+	bodyFile    string
+	bodyData    []byte
+	weight      int
+}
+
+func newResponse(config *configResponse) (*response, error) {
+	var (
+		r = response{
+			status:      config.Status,
+			headers:     config.Headers,
+			contentType: config.ContentType,
+			weight:      config.Weight,
+		}
+		err error
+	)
+
+	if r.status < 100 || r.status > 599 {
+		return nil, fmt.Errorf("invalid response status code")
+	}
+
+	if r.headerTmpls, err = newHeaderTemplates(r.headers); err != nil {
+		return nil, err
+	}
+
+	if r.weight < 0 {
+		return nil, fmt.Errorf("response weight must be positive")
+	} else if r.weight == 0 {
+		r.weight = 1
+	}
+
+	switch {
+	case config.Body != "" && config.BodyFile != "":
+		return nil, fmt.Errorf("response body and body file are mutually exclusive")
+
+	case config.BodyFile != "":
+		r.bodyFile = config.BodyFile
+		if r.bodyData, err = ioutil.ReadFile(r.bodyFile); err != nil {
+			return nil, fmt.Errorf("unable to read response body file: %s", err)
+		}
+
+		if r.contentType == "" {
+			if r.contentType = mime.TypeByExtension(filepath.Ext(r.bodyFile)); r.contentType == "" {
+				r.contentType = http.DetectContentType(r.bodyData)
+			}
+		}
+
+	default:
+		r.body = config.Body
+		if r.bodyTmpl, err = newResponseTemplate("response_body", r.body); err != nil {
+			return nil, fmt.Errorf("invalid response body template: %s", err)
+		}
+	}
+
+	return &r, nil
+}
+
+// write writes the response rendered with the request template data.
+func (r *response) write(rw http.ResponseWriter, data *templateData) error {
+	if r.contentType != "" {
+		rw.Header().Set("Content-Type", r.contentType)
+	}
+
+	if err := r.headerTmpls.render(rw.Header(), data); err != nil {
+		return err
+	}
+
+	if r.bodyFile != "" {
+		rw.WriteHeader(r.status)
+		rw.Write(r.bodyData)
+		return nil
+	}
+
+	body, err := renderTemplate(r.bodyTmpl, data)
+	if err != nil {
+		return err
+	}
+
+	rw.WriteHeader(r.status)
+
+	// Bodies of a specified content type are written as is, others are terminated by a newline for readability
+	if r.contentType != "" {
+		rw.Write(body)
+	} else {
+		fmt.Fprintf(rw, "%s\n", body)
+	}
+
+	return nil
+}
+
+func (r *response) MarshalJSON() ([]byte, error) {
+	jr := map[string]interface{}{
+		"status": r.status,
+		"weight": r.weight,
+	}
+
+	if r.bodyFile != "" {
+		jr["body_file"] = r.bodyFile
+	} else {
+		jr["body"] = r.body
+	}
+
+	if r.contentType != "" {
+		jr["content_type"] = r.contentType
+	}
+
+	if len(r.headers) > 0 {
+		jr["headers"] = r.headers
+	}
+
+	return json.Marshal(jr)
+}
+
+// responseSelector selects the response variant to return among the responses of an endpoint, either randomly
+// according to the variants weights, or in sequence (sticking to the last response once reached), or in cycle.
+type responseSelector struct {
+	mode      string
+	seed      int64
+	responses []*response
+	total     int
+	rand      *rand.Rand
+	next      int
+
+	sync.Mutex
+}
+
+func newResponseSelector(mode string, seed int64, responses []*response) (*responseSelector, error) {
+	s := responseSelector{
+		mode:      mode,
+		seed:      seed,
+		responses: responses,
+	}
+
+	switch s.mode {
+	case "":
+		s.mode = responsesWeighted
+	case responsesWeighted, responsesSequence, responsesCycle:
+	default:
+		return nil, fmt.Errorf("unsupported responses mode %q", mode)
+	}
+
+	for _, r := range responses {
+		s.total += r.weight
+	}
+
+	// A non-zero seed makes the sequence of weighted responses deterministic
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	s.rand = rand.New(rand.NewSource(seed))
+
+	return &s, nil
+}
+
+// pick returns the next response to return.
+func (s *responseSelector) pick() *response {
+	if len(s.responses) == 1 {
+		return s.responses[0]
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	switch s.mode {
+	case responsesSequence:
+		r := s.responses[s.next]
+		if s.next < len(s.responses)-1 {
+			s.next++
+		}
+		return r
+
+	case responsesCycle:
+		r := s.responses[s.next]
+		s.next = (s.next + 1) % len(s.responses)
+		return r
+	}
+
+	n := s.rand.Intn(s.total)
+	for _, r := range s.responses {
+		if n < r.weight {
+			return r
+		}
+		n -= r.weight
+	}
+
+	return s.responses[len(s.responses)-1]
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	backoffConstant    = "constant"
+	backoffExponential = "exponential"
+
+	defaultBackoffInterval = 100 * time.Millisecond
+	defaultRetryBudgetTTL  = 10 * time.Second
+	defaultRetryBudgetMin  = 3
+)
+
+var defaultRetryOn = []int{502, 503, 504}
+
+// backoff computes the delay to wait for between chain target request attempts.
+type backoff struct {
+	kind        string
+	interval    time.Duration
+	maxInterval time.Duration
+	jitter      float64
+}
+
+func newBackoff(config *configBackoff) (*backoff, error) {
+	b := backoff{
+		kind:        backoffConstant,
+		interval:    defaultBackoffInterval,
+		maxInterval: config.MaxInterval,
+		jitter:      config.Jitter,
+	}
+
+	switch config.Type {
+	case "", backoffConstant:
+	case backoffExponential:
+		b.kind = backoffExponential
+	default:
+		return nil, fmt.Errorf("unsupported backoff type %q", config.Type)
+	}
+
+	if config.Interval < 0 || config.MaxInterval < 0 {
+		return nil, fmt.Errorf("backoff intervals must be positive")
+	} else if config.Interval > 0 {
+		b.interval = config.Interval
+	}
+
+	if b.jitter < 0 || b.jitter > 1 {
+		return nil, fmt.Errorf("backoff jitter value must be 0 <= jitter <= 1")
+	}
+
+	return &b, nil
+}
+
+func (b *backoff) MarshalJSON() ([]byte, error) {
+	jb := map[string]interface{}{
+		"type":     b.kind,
+		"interval": b.interval.String(),
+	}
+
+	if b.maxInterval > 0 {
+		jb["max_interval"] = b.maxInterval.String()
+	}
+
+	if b.jitter > 0 {
+		jb["jitter"] = b.jitter
+	}
+
+	return json.Marshal(jb)
+}
+
+// delay returns the delay to wait for before the retry number n (starting at 1).
+func (b *backoff) delay(n int) time.Duration {
+	d := b.interval
+
+	if b.kind == backoffExponential {
+		d = time.Duration(float64(b.interval) * math.Pow(2, float64(n-1)))
+	}
+
+	if b.maxInterval > 0 && d > b.maxInterval {
+		d = b.maxInterval
+	}
+
+	if b.jitter > 0 {
+		d = time.Duration(float64(d) * (1 - b.jitter + 2*b.jitter*rand.Float64()))
+	}
+
+	return d
+}
+
+// retryBudget limits the number of retries an endpoint can perform to a ratio of the number of chain target
+// requests performed during the budget period (with a minimum of defaultRetryBudgetMin retries), in order to prevent
+// retry storms.
+type retryBudget struct {
+	ratio    float64
+	ttl      time.Duration
+	start    time.Time
+	requests int
+	retries  int
+
+	sync.Mutex
+}
+
+func newRetryBudget(ratio float64) (*retryBudget, error) {
+	if ratio <= 0 || ratio > 1 {
+		return nil, fmt.Errorf("retry budget value must be 0 < ratio <= 1")
+	}
+
+	return &retryBudget{
+		ratio: ratio,
+		ttl:   defaultRetryBudgetTTL,
+		start: time.Now(),
+	}, nil
+}
+
+func (b *retryBudget) reset() {
+	if time.Since(b.start) > b.ttl {
+		b.start = time.Now()
+		b.requests = 0
+		b.retries = 0
+	}
+}
+
+// request accounts for an initial chain target request.
+func (b *retryBudget) request() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.reset()
+	b.requests++
+}
+
+// withdraw returns true if the budget allows for another retry, accounting for it.
+func (b *retryBudget) withdraw() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	b.reset()
+	if b.retries >= defaultRetryBudgetMin && float64(b.retries+1) > b.ratio*float64(b.requests) {
+		return false
+	}
+	b.retries++
+
+	return true
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoffDelay(t *testing.T) {
+	testCases := []struct {
+		name   string
+		config configBackoff
+		n      int
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"default", configBackoff{}, 3, defaultBackoffInterval, defaultBackoffInterval},
+		{"constant", configBackoff{Interval: time.Second}, 3, time.Second, time.Second},
+		{"exponential first", configBackoff{Type: "exponential", Interval: time.Second}, 1, time.Second, time.Second},
+		{"exponential", configBackoff{Type: "exponential", Interval: time.Second},
+			4, 8 * time.Second, 8 * time.Second},
+		{"exponential capped", configBackoff{Type: "exponential", Interval: time.Second, MaxInterval: 5 * time.Second},
+			4, 5 * time.Second, 5 * time.Second},
+		{"jitter", configBackoff{Interval: time.Second, Jitter: 0.5}, 1, 500 * time.Millisecond, 1500 * time.Millisecond},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newBackoff(&tc.config)
+			if err != nil {
+				t.Fatalf("unable to create backoff: %s", err)
+			}
+
+			for i := 0; i < 100; i++ {
+				if d := b.delay(tc.n); d < tc.min || d > tc.max {
+					t.Fatalf("expected delay between %s and %s, got %s", tc.min, tc.max, d)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryBudget(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ratio    float64
+		requests int
+		retries  int
+	}{
+		{"minimum", 0.1, 10, defaultRetryBudgetMin},
+		{"no requests", 1, 0, defaultRetryBudgetMin},
+		{"ratio", 0.5, 20, 10},
+		{"full", 1, 20, 20},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := newRetryBudget(tc.ratio)
+			if err != nil {
+				t.Fatalf("unable to create retry budget: %s", err)
+			}
+
+			for i := 0; i < tc.requests; i++ {
+				b.request()
+			}
+
+			retries := 0
+			for b.withdraw() {
+				if retries++; retries > tc.requests+defaultRetryBudgetMin {
+					t.Fatal("retry budget never exhausted")
+				}
+			}
+
+			if retries != tc.retries {
+				t.Errorf("expected %d retries, got %d", tc.retries, retries)
+			}
+
+			// The budget is replenished once its period is over
+			b.start = b.start.Add(-2 * b.ttl)
+			if !b.withdraw() {
+				t.Error("expected retry budget to be reset after its period")
+			}
+		})
+	}
+}
+
+func TestRequestTargetRetryBudget(t *testing.T) {
+	var attempts int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	e, err := newEndpoint(&configEndpoint{
+		Method:      "GET",
+		Route:       "/a",
+		RetryBudget: 0.1,
+		Chain: []configEndpointTarget{{
+			Method:  "GET",
+			URL:     s.URL + "/",
+			Retries: 5,
+			Backoff: configBackoff{Interval: time.Millisecond},
+		}},
+	}, newTestChaos())
+	if err != nil {
+		t.Fatalf("unable to create endpoint: %s", err)
+	}
+
+	// The first request retries until the budget minimum is exhausted, the following ones are not retried
+	for i, expected := range []int{1 + defaultRetryBudgetMin, 1, 1} {
+		atomic.StoreInt32(&attempts, 0)
+
+		r := requestTarget(context.Background(), 0, e.targets[0])
+		if len(r.attempts) != expected || int(atomic.LoadInt32(&attempts)) != expected {
+			t.Errorf("request #%d: expected %d attempts, got %d (%d received)", i+1, expected, len(r.attempts),
+				atomic.LoadInt32(&attempts))
+		}
+
+		if r.last().code != http.StatusServiceUnavailable {
+			t.Errorf("request #%d: expected last attempt status %d, got %d", i+1, http.StatusServiceUnavailable,
+				r.last().code)
+		}
+	}
+}
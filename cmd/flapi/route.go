@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+type contextKey int
+
+// unmatchedRoute is the route identifying the requests not matching any route in the metrics.
+const unmatchedRoute = "<unmatched>"
+
+const (
+	// routeContextKey is the request context key of the template of the route matching the request.
+	routeContextKey contextKey = iota
+	// routeVarsContextKey is the request context key of the route variables of the request.
+	routeVarsContextKey
+	// chaosTargetContextKey is the outbound request context key of the chaos specification route of the target.
+	chaosTargetContextKey
+	// requestDataContextKey is the outbound requests context key of the inbound request template data, used to
+	// propagate the inbound request headers and body to the chain targets.
+	requestDataContextKey
+	// accessLogContextKey is the request context key of the request access log entry.
+	accessLogContextKey
+	// metricsContextKey is the request context key of the metrics middleware, used to record the chain targets
+	// requests and chaos injections metrics.
+	metricsContextKey
+	// serviceContextKey is the request context key of the name of the topology service handling the request.
+	serviceContextKey
+)
+
+// resolveRoute is a Negroni middleware resolving the template of the route matching the request, so that the
+// following middleware identify requests by route template (e.g. "/api/users/{id}") rather than by URL path. When
+// running a topology, the request is also identified by the name of the service handling it.
+func (s *service) resolveRoute(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var match mux.RouteMatch
+
+	if s.name != "" {
+		r = r.WithContext(context.WithValue(r.Context(), serviceContextKey, s.name))
+	}
+
+	if s.router.Load().(*mux.Router).Match(r, &match) && match.MatchErr == nil && match.Route != nil {
+		if tmpl, err := match.Route.GetPathTemplate(); err == nil {
+			r = r.WithContext(context.WithValue(r.Context(), routeContextKey, tmpl))
+		}
+	}
+
+	next(rw, r)
+}
+
+// requestRoute returns the template of the route matching the request, or the request URL path if it doesn't match
+// any route.
+func requestRoute(r *http.Request) string {
+	if tmpl, ok := r.Context().Value(routeContextKey).(string); ok {
+		return tmpl
+	}
+
+	return r.URL.Path
+}
+
+// routeTag returns the template of the route matching the request of the context ctx, or unmatchedRoute if it doesn't
+// match any route, so that requests to arbitrary paths don't grow the metrics cardinality.
+func routeTag(ctx context.Context) string {
+	if tmpl, ok := ctx.Value(routeContextKey).(string); ok {
+		return tmpl
+	}
+
+	return unmatchedRoute
+}
+
+// checkRoute checks that the route template is valid.
+func checkRoute(route string) error {
+	return mux.NewRouter().NewRoute().Path(route).GetError()
+}
+
+// expandRouteVars returns s with the "{name}" placeholders replaced by the values of the route variables stored in
+// the context ctx.
+func expandRouteVars(ctx context.Context, s string) string {
+	vars, _ := ctx.Value(routeVarsContextKey).(map[string]string)
+
+	for k, v := range vars {
+		s = strings.Replace(s, "{"+k+"}", url.PathEscape(v), -1)
+	}
+
+	return s
+}
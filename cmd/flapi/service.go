@@ -1,103 +1,436 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/facette/httputil"
-	"github.com/facette/logger"
-	"github.com/falzm/chaos"
 	"github.com/gorilla/mux"
 	"github.com/urfave/negroni"
 )
 
+const defaultShutdownDrainTimeout = 15 * time.Second
+
 type service struct {
-	server    *http.Server
-	endpoints []*endpoint
+	name            string
+	bindAddr        string
+	chaosBindAddr   string
+	server          *http.Server
+	router          atomic.Value
+	tls             bool
+	tlsConfig       atomic.Value
+	h2c             bool
+	instrumentation *instrumentation
+	health          *health
+	chaos           *chaos
+	endpoints       []*endpoint
+
+	shutdownConfig configShutdown
+	shutdownOnce   sync.Once
+	stopOnce       sync.Once
+	stopped        chan struct{}
+
+	sync.RWMutex
+}
+
+// serviceSettings is a validated service configuration, ready to be applied.
+type serviceSettings struct {
+	endpoints  []*endpoint
+	chaosSpecs []*chaosRouteSpec
+	scenarios  []*chaosScenario
+	tlsConfig  *tls.Config
+	health     configHealth
+	shutdown   configShutdown
 }
 
-func newService(bindAddr string, config *config) (*service, error) {
+// newService returns a new service named name (empty for a standalone service) serving the API defined in config,
+// its requests being instrumented by instrumentation.
+func newService(name, bindAddr, chaosBindAddr string, config *config,
+	instrumentation *instrumentation) (*service, error) {
 	var (
-		service  service
+		service = service{
+			name:            name,
+			bindAddr:        bindAddr,
+			chaosBindAddr:   chaosBindAddr,
+			instrumentation: instrumentation,
+		}
 		handlers *negroni.Negroni
-		router   *mux.Router
 		err      error
 	)
 
-	httpMetrics, err := newMetricsMiddleware(&metricsMiddlewareConfig{
-		service:           "flapi",
-		reqLatencyBuckets: config.Metrics.LatencyHistogramBuckets,
-	})
+	service.health = newHealth(service.currentEndpoints)
+
+	// The listener protocols are set at startup, only the TLS settings can be changed by reloading the configuration
+	service.tls = config.Server.TLS != nil
+	service.h2c = config.Server.H2C
+
+	service.chaos, err = newChaos(chaosBindAddr, &service)
 	if err != nil {
-		return nil, fmt.Errorf("metrics middleware init error: %s", err)
+		return nil, fmt.Errorf("chaos middleware init error: %s", err)
 	}
 
-	httpChaos, err := chaos.NewChaos("127.0.0.1:8666")
+	settings, err := service.prepare(bindAddr, chaosBindAddr, config)
 	if err != nil {
-		return nil, fmt.Errorf("chaos middleware init error: %s", err)
+		return nil, err
 	}
+	service.apply(settings)
+
+	instrumentation.metrics.registerCircuitBreakers(name, service.currentEndpoints)
+
+	// /!\ Middleware chain order matters:
+	// - request ID assignment and route resolution must be performed first, since the following middleware identify
+	//   requests by ID and route
+	// - tracing must precede access logging, so that access log entries carry the request trace ID
+	// - logging/metrics/tracing middleware must be added first, since they measure the whole request process latency
+	// - chaos middleware must be added last as it disrupts the request process flow, so instrumentation must
+	//   be happen before
+	handlers = negroni.New(
+		negroni.HandlerFunc(requestID),
+		negroni.HandlerFunc(service.resolveRoute),
+		instrumentation.tracing,
+		instrumentation.accessLog,
+		instrumentation.metrics,
+		service.chaos,
+	)
 
-	router = mux.NewRouter()
+	handlers.UseHandler(&service)
 
-	service.endpoints = make([]*endpoint, len(config.Endpoints))
+	service.server = &http.Server{
+		Addr:      bindAddr,
+		Handler:   handlers,
+		Protocols: new(http.Protocols),
+	}
+
+	service.stopped = make(chan struct{})
+
+	service.server.Protocols.SetHTTP1(true)
+
+	if service.tls {
+		service.server.Protocols.SetHTTP2(true)
+		service.server.TLSConfig = &tls.Config{
+			GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+				return service.tlsConfig.Load().(*tls.Config), nil
+			},
+		}
+	} else if service.h2c {
+		service.server.Protocols.SetUnencryptedHTTP2(true)
+	}
+
+	return &service, nil
+}
+
+// prepare checks the service configuration and bind addresses, returning the API endpoints, chaos specifications and scenarios, TLS,
+// health and shutdown settings to apply. The metrics, tracing and access log settings are handled by the
+// instrumentation.
+func (s *service) prepare(bindAddr, chaosBindAddr string, config *config) (*serviceSettings, error) {
+	var (
+		settings = serviceSettings{
+			health:   config.Health,
+			shutdown: config.Shutdown,
+		}
+		err error
+	)
+
+	if bindAddr != s.bindAddr || chaosBindAddr != s.chaosBindAddr {
+		return nil, fmt.Errorf("invalid server configuration: bind addresses cannot be changed without restarting")
+	}
+
+	if (config.Server.TLS != nil) != s.tls || config.Server.H2C != s.h2c {
+		return nil, fmt.Errorf("invalid server configuration: TLS and h2c cannot be enabled or disabled without restarting")
+	}
+
+	if config.Server.TLS != nil {
+		if config.Server.H2C {
+			return nil, fmt.Errorf("invalid server configuration: TLS and h2c are mutually exclusive")
+		}
+
+		if settings.tlsConfig, err = newServerTLSConfig(config.Server.TLS); err != nil {
+			return nil, fmt.Errorf("invalid server TLS configuration: %s", err)
+		}
+	}
+
+	if err := checkHealthConfig(&config.Health); err != nil {
+		return nil, fmt.Errorf("invalid health configuration: %s", err)
+	}
+
+	if err := checkShutdownConfig(&config.Shutdown); err != nil {
+		return nil, fmt.Errorf("invalid shutdown configuration: %s", err)
+	}
+
+	settings.endpoints = make([]*endpoint, 0, len(config.Endpoints))
 	for i, _ := range config.Endpoints {
-		e, err := newEndpoint(
-			config.Endpoints[i].Method,
-			apiPrefix+config.Endpoints[i].Route,
-			config.Endpoints[i].ResponseStatus,
-			config.Endpoints[i].ResponseBody,
-			config.Endpoints[i].Chain,
-		)
+		e, err := newEndpoint(config.Endpoints[i], s.chaos)
 		if err != nil {
 			return nil, fmt.Errorf("invalid endpoint: %s", err)
 		}
 
-		service.endpoints[i] = e
-		router.HandleFunc(e.route, e.handler).
-			Methods(e.method)
-		log.Debug("registered API endpoint %s %s", e.method, e.route)
+		settings.endpoints = append(settings.endpoints, e)
+
+		specs, err := endpointChaosSpecs(config.Endpoints[i], e)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint %s %s", e, err)
+		}
+		settings.chaosSpecs = append(settings.chaosSpecs, specs...)
+	}
+
+	if err := checkEndpointsRoutes(settings.endpoints); err != nil {
+		return nil, fmt.Errorf("invalid endpoint: %s", err)
 	}
 
-	if len(service.endpoints) == 0 {
+	if len(settings.endpoints) == 0 {
 		log.Warning("no API endpoints registered, check your configuration")
 	}
 
-	router.HandleFunc("/", service.handler).
-		Methods("GET")
+	for _, c := range config.Chaos {
+		if c.Method == "" {
+			return nil, fmt.Errorf("invalid chaos specification: method not specified")
+		}
 
-	router.HandleFunc("/metrics", httpMetrics.HandleMetrics).
-		Methods("GET")
+		path, err := chaosRoutePath(c)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos specification: %s", err)
+		}
 
-	// /!\ Middleware chain order matters:
-	// - logging/metrics/tracing middleware must be added first, since they measure the whole request process latency
-	// - chaos middleware must be added last as it disrupts the request process flow, so instrumentation must
-	//   be happen before
-	handlers = negroni.New(
-		negroni.NewLogger(),
-		httpMetrics,
-		httpChaos,
-	)
+		spec, err := newChaosSpec(&c.configChaosSpec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos specification for %s %s: %s", c.Method, path, err)
+		}
 
-	handlers.UseHandler(router)
+		settings.chaosSpecs = append(settings.chaosSpecs, &chaosRouteSpec{method: c.Method, path: path, spec: spec})
+	}
 
-	service.server = &http.Server{
-		Addr:    bindAddr,
-		Handler: handlers,
+	names := make(map[string]bool, len(config.ChaosScenarios))
+	for _, c := range config.ChaosScenarios {
+		scenario, err := newChaosScenario(c, s.chaos.controller)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chaos scenario: %s", err)
+		}
+
+		if names[scenario.name] {
+			return nil, fmt.Errorf("invalid chaos scenario: duplicate scenario name %q", scenario.name)
+		}
+		names[scenario.name] = true
+
+		settings.scenarios = append(settings.scenarios, scenario)
 	}
 
-	return &service, nil
+	return &settings, nil
+}
+
+// endpointChaosSpecs returns the chaos specifications of the endpoint e routes and chain targets, as defined in the
+// endpoint configuration.
+func endpointChaosSpecs(config *configEndpoint, e *endpoint) ([]*chaosRouteSpec, error) {
+	var specs []*chaosRouteSpec
+
+	if config.Chaos != nil {
+		spec, err := newChaosSpec(config.Chaos)
+		if err != nil {
+			return nil, fmt.Errorf("chaos specification: %s", err)
+		}
+
+		for _, route := range e.routes() {
+			specs = append(specs, &chaosRouteSpec{method: route.method, path: route.route, spec: spec})
+		}
+	}
+
+	for i, t := range e.targets {
+		if config.Chain[i].Chaos == nil {
+			continue
+		}
+
+		spec, err := newChaosSpec(config.Chain[i].Chaos)
+		if err != nil {
+			return nil, fmt.Errorf("chain target chaos specification: %s", err)
+		}
+
+		specs = append(specs, &chaosRouteSpec{method: t.method, path: t.url.Host + t.url.Path, spec: spec})
+	}
+
+	return specs, nil
+}
+
+// apply replaces the service API endpoints, chaos specifications and scenarios, TLS, health and shutdown settings by
+// settings.
+func (s *service) apply(settings *serviceSettings) {
+	s.health.configure(&settings.health)
+
+	if settings.tlsConfig != nil {
+		s.tlsConfig.Store(settings.tlsConfig)
+	}
+
+	s.Lock()
+	s.setEndpoints(settings.endpoints)
+	s.shutdownConfig = settings.shutdown
+	s.Unlock()
+
+	for _, e := range settings.endpoints {
+		log.Debug("registered API endpoint %s", e)
+	}
+
+	s.chaos.loadSpecs(settings.chaosSpecs)
+	s.chaos.loadScenarios(settings.scenarios)
 }
 
+// checkShutdownConfig checks that the shutdown configuration is valid.
+func checkShutdownConfig(config *configShutdown) error {
+	if config.PreStopDelay < 0 || config.DrainTimeout < 0 || config.ExitDelay < 0 {
+		return fmt.Errorf("durations must be positive")
+	}
+
+	return nil
+}
+
+// run serves the API until the service is shut down, returning once the shutdown has completed.
 func (s *service) run() error {
-	return s.server.ListenAndServe()
+	var err error
+
+	if s.tls {
+		// The certificates are provided by the TLS configuration
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+
+	if err == http.ErrServerClosed {
+		<-s.stopped
+	}
+
+	return err
 }
 
-func (s *service) shutdown() error {
-	logger.Notice("shutting down")
+// shutdown gracefully shuts the service down: the service first reports not being ready while still serving
+// requests during the pre-stop delay, so that load balancers stop sending it new requests. The listener is then
+// closed and the in-flight requests are given the drain timeout to complete, before the service is stopped after the
+// optional exit delay. If shutdown is called again while shutting down, the service is stopped immediately.
+func (s *service) shutdown() {
+	forced := true
 
-	return s.server.Close()
+	s.shutdownOnce.Do(func() {
+		forced = false
+		go s.gracefulShutdown()
+	})
+
+	if forced {
+		log.Warning("forcing shutdown")
+		s.close()
+	}
+}
+
+// close stops the service immediately, closing its listeners and connections.
+func (s *service) close() {
+	s.server.Close()
+	s.chaos.close()
+	s.stop()
+}
+
+func (s *service) gracefulShutdown() {
+	s.RLock()
+	config := s.shutdownConfig
+	s.RUnlock()
+
+	log.Notice("shutting down")
+
+	s.health.setShuttingDown()
+
+	if config.PreStopDelay > 0 {
+		log.Info("waiting %s before stopping serving requests", config.PreStopDelay)
+		time.Sleep(config.PreStopDelay)
+	}
+
+	ctx := context.Background()
+	if config.DrainTimeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, config.DrainTimeout)
+		defer cancel()
+	}
+
+	log.Info("draining in-flight requests")
+
+	if err := s.server.Shutdown(ctx); err != nil {
+		log.Warning("in-flight requests not completed after %s, closing remaining connections",
+			config.DrainTimeout)
+		s.server.Close()
+	}
+
+	s.chaos.close()
+
+	if config.ExitDelay > 0 {
+		log.Info("waiting %s before exiting", config.ExitDelay)
+		time.Sleep(config.ExitDelay)
+	}
+
+	s.stop()
+}
+
+// stop signals that the service is stopped, making run return.
+func (s *service) stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
+}
+
+// ServeHTTP dispatches the request using the current service router.
+func (s *service) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.router.Load().(*mux.Router).ServeHTTP(rw, r)
+}
+
+// setEndpoints replaces the service API endpoints, atomically swapping the service router so that in-flight
+// requests keep being served by the previous one. The caller must hold the service lock when the service is running.
+func (s *service) setEndpoints(endpoints []*endpoint) {
+	router := mux.NewRouter()
+
+	for _, e := range endpoints {
+		for _, route := range e.routes() {
+			router.HandleFunc(route.route, route.handler).
+				Methods(route.method)
+		}
+	}
+
+	router.HandleFunc("/", s.handler).
+		Methods("GET")
+
+	router.HandleFunc("/metrics", s.instrumentation.metrics.HandleMetrics).
+		Methods("GET")
+
+	router.HandleFunc("/healthz", s.health.handleLiveness).
+		Methods("GET")
+
+	router.HandleFunc("/readyz", s.health.handleReadiness).
+		Methods("GET")
+
+	s.endpoints = endpoints
+	s.router.Store(router)
+}
+
+// currentEndpoints returns the service API endpoints.
+func (s *service) currentEndpoints() []*endpoint {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.endpoints
 }
 
 func (s *service) handler(rw http.ResponseWriter, r *http.Request) {
-	httputil.WriteJSON(rw, s.endpoints, http.StatusOK)
+	httputil.WriteJSON(rw, s.currentEndpoints(), http.StatusOK)
+}
+
+// checkEndpointsRoutes checks that the routes served by the endpoints don't overlap.
+func checkEndpointsRoutes(endpoints []*endpoint) error {
+	routes := make(map[string]*endpoint)
+
+	for _, e := range endpoints {
+		for _, route := range e.routes() {
+			if cur, ok := routes[route.method+" "+route.route]; ok {
+				return fmt.Errorf("route %s %s of endpoint %s already served by endpoint %s",
+					route.method, route.route, e, cur)
+			}
+			routes[route.method+" "+route.route] = e
+		}
+	}
+
+	return nil
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+var templateCounters = struct {
+	values map[string]int64
+	sync.Mutex
+}{values: make(map[string]int64)}
+
+// templateFuncs are the helper functions available in response body templates.
+var templateFuncs = template.FuncMap{
+	"uuid": newUUID,
+	"now":  time.Now,
+	"randInt": func(min, max int) (int, error) {
+		if max <= min {
+			return 0, fmt.Errorf("randInt: max must be greater than min")
+		}
+
+		return min + mathrand.Intn(max-min), nil
+	},
+	"randChoice": func(choices ...interface{}) (interface{}, error) {
+		if len(choices) == 0 {
+			return nil, fmt.Errorf("randChoice: no choices specified")
+		}
+
+		return choices[mathrand.Intn(len(choices))], nil
+	},
+	"counter": func(name string) int64 {
+		templateCounters.Lock()
+		defer templateCounters.Unlock()
+
+		templateCounters.values[name]++
+
+		return templateCounters.values[name]
+	},
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// newUUID returns a random (version 4) UUID.
+func newUUID() string {
+	var b [16]byte
+
+	rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// templateData is the data exposed to the response body templates.
+type templateData struct {
+	Method   string
+	Path     string
+	Vars     map[string]string
+	Query    url.Values
+	Headers  http.Header
+	Body     interface{}
+	RawBody  string
+	Hostname string
+	Version  string
+}
+
+func newResponseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Parse(text)
+}
+
+// newTemplateData returns the template data of the request r. If the request body is valid JSON, it is exposed
+// decoded as Body in addition to its raw content as RawBody.
+func newTemplateData(r *http.Request) (*templateData, error) {
+	data := templateData{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		Vars:     mux.Vars(r),
+		Query:    r.URL.Query(),
+		Headers:  r.Header,
+		Hostname: hostname,
+		Version:  version,
+	}
+
+	if r.Body != nil {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read request body: %s", err)
+		}
+
+		data.RawBody = string(body)
+
+		if len(body) > 0 {
+			json.Unmarshal(body, &data.Body)
+		}
+	}
+
+	// Default to an empty object so that templates can refer to body fields whether the request has a body or not
+	if data.Body == nil {
+		data.Body = map[string]interface{}{}
+	}
+
+	return &data, nil
+}
+
+// renderTemplate executes the template tmpl with the request template data.
+func renderTemplate(tmpl *template.Template, data *templateData) ([]byte, error) {
+	var buf bytes.Buffer
+
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
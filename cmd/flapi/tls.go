@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	tlsClientAuthRequire  = "require"
+	tlsClientAuthOptional = "optional"
+
+	targetProtocolHTTP1 = "http1"
+	targetProtocolHTTP2 = "http2"
+	targetProtocolH2C   = "h2c"
+
+	defaultTLSSelfSignedValidity = 365 * 24 * time.Hour
+)
+
+// newServerTLSConfig returns the TLS configuration of the API listener defined in the server TLS configuration.
+func newServerTLSConfig(config *configServerTLS) (*tls.Config, error) {
+	var (
+		tlsConfig = tls.Config{
+			MinVersion: tls.VersionTLS12,
+			NextProtos: []string{"h2", "http/1.1"},
+		}
+		cert tls.Certificate
+		err  error
+	)
+
+	switch {
+	case config.SelfSigned && (config.CertFile != "" || config.KeyFile != ""):
+		return nil, fmt.Errorf("self-signed certificate and certificate files are mutually exclusive")
+
+	case config.SelfSigned:
+		if config.SelfSignedValidity < 0 {
+			return nil, fmt.Errorf("self-signed certificate validity must be positive")
+		}
+
+		validity := config.SelfSignedValidity
+		if validity == 0 {
+			validity = defaultTLSSelfSignedValidity
+		}
+
+		if cert, err = newSelfSignedCertificate(validity); err != nil {
+			return nil, fmt.Errorf("unable to generate self-signed certificate: %s", err)
+		}
+
+		log.Info("generated self-signed certificate (SHA-256 fingerprint: %x), valid until %s",
+			sha256.Sum256(cert.Certificate[0]), cert.Leaf.NotAfter.Format(time.RFC3339))
+
+	case config.CertFile != "" && config.KeyFile != "":
+		if cert, err = tls.LoadX509KeyPair(config.CertFile, config.KeyFile); err != nil {
+			return nil, fmt.Errorf("unable to load certificate: %s", err)
+		}
+
+	default:
+		return nil, fmt.Errorf("either certificate and key files or self-signed certificate must be specified")
+	}
+
+	tlsConfig.Certificates = []tls.Certificate{cert}
+
+	if config.ClientCAFile != "" {
+		if tlsConfig.ClientCAs, err = loadCertPool(config.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("client CA: %s", err)
+		}
+
+		switch config.ClientAuth {
+		case tlsClientAuthRequire, "":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		case tlsClientAuthOptional:
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unsupported client auth mode %q", config.ClientAuth)
+		}
+	} else if config.ClientAuth != "" {
+		return nil, fmt.Errorf("client auth requires a client CA file")
+	}
+
+	return &tlsConfig, nil
+}
+
+// newSelfSignedCertificate returns a self-signed certificate valid for the host name and the loopback addresses
+// during validity.
+func newSelfSignedCertificate(validity time.Duration) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hostname, Organization: []string{"flapi"}},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{hostname, "localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
+
+// loadCertPool returns a certificate pool containing the PEM-encoded certificates of the file at path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no valid certificate found in %s", path)
+	}
+
+	return pool, nil
+}
+
+// newTargetTransport returns the transport performing the requests to the chain target at u, according to its TLS
+// settings and HTTP protocol. Targets without specific settings share the default transport.
+func newTargetTransport(u *url.URL, config *configTargetTLS, protocol string) (*http.Transport, error) {
+	if config == nil && protocol == "" {
+		return http.DefaultTransport.(*http.Transport), nil
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config != nil {
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("TLS settings require an https URL")
+		}
+
+		transport.TLSClientConfig = &tls.Config{
+			ServerName:         config.ServerName,
+			InsecureSkipVerify: config.InsecureSkipVerify,
+		}
+
+		if config.CAFile != "" {
+			pool, err := loadCertPool(config.CAFile)
+			if err != nil {
+				return nil, fmt.Errorf("CA: %s", err)
+			}
+			transport.TLSClientConfig.RootCAs = pool
+		}
+
+		switch {
+		case config.CertFile != "" && config.KeyFile != "":
+			cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("unable to load client certificate: %s", err)
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+
+		case config.CertFile != "" || config.KeyFile != "":
+			return nil, fmt.Errorf("client certificate requires both certificate and key files")
+		}
+	}
+
+	transport.Protocols = new(http.Protocols)
+
+	switch protocol {
+	case "":
+		transport.Protocols.SetHTTP1(true)
+		transport.Protocols.SetHTTP2(true)
+
+	case targetProtocolHTTP1:
+		transport.Protocols.SetHTTP1(true)
+
+	case targetProtocolHTTP2:
+		if u.Scheme != "https" {
+			return nil, fmt.Errorf("protocol %s requires an https URL, use %s for HTTP/2 over cleartext",
+				targetProtocolHTTP2, targetProtocolH2C)
+		}
+		transport.Protocols.SetHTTP2(true)
+
+	case targetProtocolH2C:
+		if u.Scheme != "http" {
+			return nil, fmt.Errorf("protocol %s requires an http URL", targetProtocolH2C)
+		}
+		transport.Protocols.SetUnencryptedHTTP2(true)
+
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", protocol)
+	}
+
+	return transport, nil
+}
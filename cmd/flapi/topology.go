@@ -0,0 +1,461 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// topologyServiceNameRegexp matches the valid topology service names, which are used as DNS names when deploying
+// the topology (RFC 1123 labels).
+var topologyServiceNameRegexp = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]{0,61}[a-z0-9])?$`)
+
+// configTopologyService is the configuration of a topology service, either defined inline or loaded from a
+// configuration file.
+type configTopologyService struct {
+	Name          string
+	BindAddr      string
+	ChaosBindAddr string
+	ConfigFile    string
+
+	config *config
+	// settings are the service configuration settings as defined in the topology or configuration file, the
+	// metrics, tracing and access log settings excluded
+	settings yaml.MapSlice
+}
+
+// configTopology is the configuration of a set of services running in a single process. The metrics, tracing and
+// access log settings apply to all the services.
+type configTopology struct {
+	Metrics   configMetrics
+	Tracing   configTracing
+	AccessLog configAccessLog
+	Services  []*configTopologyService
+
+	// settings are the metrics, tracing and access log settings as defined in the topology file
+	settings yaml.MapSlice
+}
+
+// newStandaloneTopology returns the topology configuration of a single service configured by config, listening on
+// bindAddr with chaos management controller listening on chaosBindAddr.
+func newStandaloneTopology(config *config, bindAddr, chaosBindAddr string) (*configTopology, error) {
+	t := configTopology{
+		Metrics:   config.Metrics,
+		Tracing:   config.Tracing,
+		AccessLog: config.AccessLog,
+		Services: []*configTopologyService{{
+			BindAddr:      bindAddr,
+			ChaosBindAddr: chaosBindAddr,
+			config:        config,
+		}},
+	}
+
+	if err := t.resolveServices(localServiceURL); err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// loadTopology loads the topology file at path, the chain targets referencing topology services being resolved to
+// the services local addresses.
+func loadTopology(path string) (*configTopology, error) {
+	t, err := readTopology(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.resolveServices(localServiceURL); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// readTopology reads the topology file at path, leaving the references to topology services unresolved.
+func readTopology(path string) (*configTopology, error) {
+	var (
+		settings yaml.MapSlice
+		raw      struct {
+			Services []yaml.MapSlice `yaml:"services"`
+		}
+	)
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal YAML data")
+	}
+
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal YAML data")
+	}
+
+	var common yaml.MapSlice
+	for _, item := range settings {
+		switch item.Key {
+		case "metrics", "tracing", "access_log":
+			common = append(common, item)
+		case "services":
+		default:
+			return nil, fmt.Errorf("unsupported topology setting %q", item.Key)
+		}
+	}
+
+	// The services being ignored by the configuration structure, the instrumentation settings are parsed as a
+	// service configuration so that the defaults and paths resolution apply
+	c, err := parseConfig(data, path)
+	if err != nil {
+		return nil, err
+	}
+
+	t := configTopology{
+		Metrics:   c.Metrics,
+		Tracing:   c.Tracing,
+		AccessLog: c.AccessLog,
+		settings:  common,
+	}
+
+	if len(raw.Services) == 0 {
+		return nil, fmt.Errorf("no services defined")
+	}
+
+	names := make(map[string]bool)
+	for i, item := range raw.Services {
+		s, err := parseTopologyService(item, path)
+		if err != nil {
+			if s.Name != "" {
+				return nil, fmt.Errorf("service %q: %s", s.Name, err)
+			}
+			return nil, fmt.Errorf("service #%d: %s", i+1, err)
+		}
+
+		if names[s.Name] {
+			return nil, fmt.Errorf("duplicate service name %q", s.Name)
+		}
+		names[s.Name] = true
+
+		t.Services = append(t.Services, s)
+	}
+
+	return &t, nil
+}
+
+// parseTopologyService parses the topology service definition item of the topology file at path, returning the
+// service settings parsed so far along with the error if the definition is invalid.
+func parseTopologyService(item yaml.MapSlice, path string) (*configTopologyService, error) {
+	var (
+		s      configTopologyService
+		inline yaml.MapSlice
+		err    error
+	)
+
+	for _, kv := range item {
+		key, _ := kv.Key.(string)
+
+		switch key {
+		case "name", "bind_addr", "chaos_bind_addr", "config_file":
+			value, ok := kv.Value.(string)
+			if !ok {
+				return &s, fmt.Errorf("%s must be a string", key)
+			}
+
+			switch key {
+			case "name":
+				s.Name = value
+			case "bind_addr":
+				s.BindAddr = value
+			case "chaos_bind_addr":
+				s.ChaosBindAddr = value
+			case "config_file":
+				s.ConfigFile = resolveConfigPath(path, value)
+			}
+
+		case "metrics", "tracing", "access_log":
+			return &s, fmt.Errorf("%s settings must be set at the topology level", key)
+
+		default:
+			inline = append(inline, kv)
+		}
+	}
+
+	switch {
+	case s.Name == "":
+		return &s, fmt.Errorf("name not specified")
+	case !topologyServiceNameRegexp.MatchString(s.Name):
+		return &s, fmt.Errorf("invalid name, must consist of lower case alphanumeric characters or '-'")
+	case s.BindAddr == "":
+		return &s, fmt.Errorf("bind address not specified")
+	case s.ChaosBindAddr == "":
+		return &s, fmt.Errorf("chaos bind address not specified")
+	}
+
+	if s.ConfigFile != "" {
+		if len(inline) > 0 {
+			return &s, fmt.Errorf("configuration file and inline configuration are mutually exclusive")
+		}
+
+		if s.config, s.settings, err = loadTopologyServiceConfig(s.ConfigFile); err != nil {
+			return &s, fmt.Errorf("unable to load configuration: %s", err)
+		}
+
+		return &s, nil
+	}
+
+	data, err := yaml.Marshal(inline)
+	if err != nil {
+		return &s, err
+	}
+
+	if s.config, err = parseConfig(data, path); err != nil {
+		return &s, err
+	}
+	s.settings = inline
+
+	return &s, nil
+}
+
+// loadTopologyServiceConfig loads the service configuration file at path, returning the configuration along with
+// its settings. Since they apply to all the topology services, the metrics, tracing and access log settings it
+// contains are ignored.
+func loadTopologyServiceConfig(path string) (*config, yaml.MapSlice, error) {
+	var all, settings yaml.MapSlice
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := parseConfig(data, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := yaml.Unmarshal(data, &all); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal YAML data")
+	}
+
+	for _, item := range all {
+		switch item.Key {
+		case "metrics", "tracing", "access_log":
+			log.Warning("%s: ignoring %s settings, set at the topology level", path, item.Key)
+		default:
+			settings = append(settings, item)
+		}
+	}
+
+	return config, settings, nil
+}
+
+// resolveServices resolves the chain targets and chaos specifications referencing topology services into URLs,
+// serviceURL returning the base URL of a service.
+func (t *configTopology) resolveServices(serviceURL func(*configTopologyService) string) error {
+	services := make(map[string]*configTopologyService)
+	for _, s := range t.Services {
+		if s.Name != "" {
+			services[s.Name] = s
+		}
+	}
+
+	resolve := func(service, path string, url *string) error {
+		switch {
+		case service == "" && path != "":
+			return fmt.Errorf("path requires a service")
+		case service == "":
+			return nil
+		case *url != "":
+			return fmt.Errorf("url and service are mutually exclusive")
+		case !strings.HasPrefix(path, "/"):
+			return fmt.Errorf("path must start with /")
+		}
+
+		target, ok := services[service]
+		if !ok {
+			return fmt.Errorf("unknown service %q", service)
+		}
+
+		*url = serviceURL(target) + path
+
+		return nil
+	}
+
+	for _, s := range t.Services {
+		var prefix string
+		if s.Name != "" {
+			prefix = fmt.Sprintf("service %q: ", s.Name)
+		}
+
+		for _, e := range s.config.Endpoints {
+			for i := range e.Chain {
+				c := &e.Chain[i]
+				if err := resolve(c.Service, c.Path, &c.URL); err != nil {
+					return fmt.Errorf("%sinvalid endpoint %s %s chain target: %s", prefix, e.Method, e.Route, err)
+				}
+			}
+		}
+
+		for _, c := range s.config.Chaos {
+			if err := resolve(c.Service, c.Path, &c.URL); err != nil {
+				return fmt.Errorf("%sinvalid chaos specification: %s", prefix, err)
+			}
+		}
+
+		for _, sc := range s.config.ChaosScenarios {
+			for i := range sc.Steps {
+				c := &sc.Steps[i].configChaosRoute
+				if err := resolve(c.Service, c.Path, &c.URL); err != nil {
+					return fmt.Errorf("%sinvalid chaos scenario %q: %s", prefix, sc.Name, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// localServiceURL returns the base URL of the service s running in the local process.
+func localServiceURL(s *configTopologyService) string {
+	scheme := "http"
+	if s.config.Server.TLS != nil {
+		scheme = "https"
+	}
+
+	host, port, err := net.SplitHostPort(s.BindAddr)
+	if err != nil {
+		return scheme + "://" + s.BindAddr
+	}
+
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		host = "localhost"
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+// topology is a set of services running in a single process.
+type topology struct {
+	instrumentation *instrumentation
+	services        []*service
+}
+
+// newTopology returns a new topology running the services defined in config.
+func newTopology(config *configTopology) (*topology, error) {
+	var (
+		t   topology
+		err error
+	)
+
+	// The requests of a topology declaring named services are identified by service in the metrics
+	if t.instrumentation, err = newInstrumentation(config, config.Services[0].Name != ""); err != nil {
+		return nil, err
+	}
+
+	for _, c := range config.Services {
+		s, err := newService(c.Name, c.BindAddr, c.ChaosBindAddr, c.config, t.instrumentation)
+		if err != nil {
+			t.close()
+			return nil, serviceError(c.Name, err)
+		}
+
+		t.services = append(t.services, s)
+	}
+
+	return &t, nil
+}
+
+// configure applies the configuration to the topology services and instrumentation, only if it is valid as a whole.
+// The topology services cannot be changed while running.
+func (t *topology) configure(config *configTopology) error {
+	if len(config.Services) != len(t.services) {
+		return fmt.Errorf("services cannot be added or removed without restarting")
+	}
+
+	for i, c := range config.Services {
+		if c.Name != t.services[i].name {
+			return fmt.Errorf("services cannot be added, removed or renamed without restarting")
+		}
+	}
+
+	instrumentationSettings, err := t.instrumentation.prepare(config)
+	if err != nil {
+		return err
+	}
+
+	settings := make([]*serviceSettings, len(t.services))
+	for i, s := range t.services {
+		c := config.Services[i]
+		if settings[i], err = s.prepare(c.BindAddr, c.ChaosBindAddr, c.config); err != nil {
+			instrumentationSettings.discard()
+			return serviceError(s.name, err)
+		}
+	}
+
+	if err := t.instrumentation.apply(instrumentationSettings); err != nil {
+		return err
+	}
+
+	for i, s := range t.services {
+		s.apply(settings[i])
+	}
+
+	return nil
+}
+
+// run serves the topology services APIs until they are shut down. If a service fails to serve, the whole topology
+// is stopped.
+func (t *topology) run() error {
+	var (
+		results = make(chan error, len(t.services))
+		err     error
+	)
+
+	for _, s := range t.services {
+		go func(s *service) {
+			if err := s.run(); err != nil && err != http.ErrServerClosed {
+				results <- serviceError(s.name, err)
+				return
+			}
+			results <- nil
+		}(s)
+	}
+
+	for range t.services {
+		if e := <-results; e != nil && err == nil {
+			err = e
+			t.close()
+		}
+	}
+
+	return err
+}
+
+// shutdown gracefully shuts the topology services down, see service.shutdown.
+func (t *topology) shutdown() {
+	for _, s := range t.services {
+		s.shutdown()
+	}
+}
+
+// close stops the topology services immediately.
+func (t *topology) close() {
+	for _, s := range t.services {
+		s.close()
+	}
+}
+
+// serviceError returns err prefixed with the name of the topology service it relates to, if any.
+func serviceError(name string, err error) error {
+	if name == "" {
+		return err
+	}
+
+	return fmt.Errorf("service %q: %s", name, err)
+}
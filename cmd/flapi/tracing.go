@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/urfave/negroni"
+	"go.opencensus.io/trace"
+)
+
+const (
+	defaultTracingServiceName  = "flapi"
+	defaultTracingSamplingRate = 1.0
+
+	// spanKindAttribute is the span attribute reporting whether the span is a server or client one, mapped to the
+	// span kind by the exporters supporting it.
+	spanKindAttribute = "span.kind"
+	spanKindServer    = "server"
+	spanKindClient    = "client"
+
+	// spanServiceAttribute is the span attribute reporting the name of the topology service the span belongs to,
+	// overriding the configured service name in the exported spans.
+	spanServiceAttribute = "flapi.service"
+
+	// traceStatusUnknown is the OpenCensus (i.e. gRPC) status code of failed spans.
+	traceStatusUnknown = 2
+)
+
+// tracing is a Negroni middleware tracing the requests processing: a span is started for every inbound request,
+// continuing the trace propagated by the client if any.
+type tracing struct {
+	exporters []spanExporter
+
+	sync.Mutex
+}
+
+func newTracing() *tracing {
+	return &tracing{}
+}
+
+// checkTracingConfig checks that the tracing configuration is valid.
+func checkTracingConfig(config *configTracing) error {
+	if config.SamplingRate < 0 || config.SamplingRate > 1 {
+		return fmt.Errorf("sampling rate must be between 0 and 1")
+	}
+
+	if config.ServiceName == "" {
+		return fmt.Errorf("service name not specified")
+	}
+
+	return nil
+}
+
+// configure sets the traces sampling rate and replaces the current span exporters by exporters, flushing the spans
+// pending in the current ones.
+func (t *tracing) configure(samplingRate float64, exporters []spanExporter) {
+	t.Lock()
+	defer t.Unlock()
+
+	trace.SetDefaultSampler(trace.ProbabilitySampler(samplingRate))
+
+	for _, e := range t.exporters {
+		trace.UnregisterExporter(e)
+		e.close()
+	}
+
+	for _, e := range exporters {
+		trace.RegisterExporter(e)
+	}
+
+	t.exporters = exporters
+}
+
+// close flushes and closes the span exporters.
+func (t *tracing) close() {
+	t.configure(0, nil)
+}
+
+func (t *tracing) ServeHTTP(rw http.ResponseWriter, r *http.Request, next http.HandlerFunc) {
+	var (
+		ctx  context.Context
+		span *trace.Span
+		name = r.Method + " " + requestRoute(r)
+	)
+
+	if parent, ok := extractSpanContext(r.Header); ok {
+		ctx, span = trace.StartSpanWithRemoteParent(r.Context(), name, parent, trace.StartOptions{})
+	} else {
+		ctx, span = trace.StartSpan(r.Context(), name)
+	}
+	defer span.End()
+
+	span.SetAttributes(
+		trace.StringAttribute{Key: spanKindAttribute, Value: spanKindServer},
+		trace.StringAttribute{Key: "http.method", Value: r.Method},
+		trace.StringAttribute{Key: "http.route", Value: requestRoute(r)},
+		trace.StringAttribute{Key: "http.path", Value: r.URL.Path},
+		trace.StringAttribute{Key: "http.request_id", Value: r.Header.Get(requestIDHeader)},
+		trace.StringAttribute{Key: "flapi.host", Value: hostname},
+	)
+
+	if name, ok := r.Context().Value(serviceContextKey).(string); ok {
+		span.SetAttributes(trace.StringAttribute{Key: spanServiceAttribute, Value: name})
+	}
+
+	next(rw, r.WithContext(ctx))
+
+	status := rw.(negroni.ResponseWriter).Status()
+
+	span.SetAttributes(trace.Int64Attribute{Key: "http.status_code", Value: int64(status)})
+	if status >= 500 {
+		span.SetStatus(trace.Status{Code: traceStatusUnknown, Message: http.StatusText(status)})
+	}
+}
+
+// traceID returns the ID of the trace the request belongs to, or an empty string if it isn't traced.
+func traceID(r *http.Request) string {
+	sc := trace.FromContext(r.Context()).SpanContext()
+	if sc.TraceID == (trace.TraceID{}) {
+		return ""
+	}
+
+	return sc.TraceID.String()
+}
+
+// injectSpanContext sets the W3C Trace Context and B3 propagation headers of the span context sc to header.
+func injectSpanContext(sc trace.SpanContext, header http.Header) {
+	if sc.TraceID == (trace.TraceID{}) {
+		return
+	}
+
+	flags, sampled := "00", "0"
+	if sc.IsSampled() {
+		flags, sampled = "01", "1"
+	}
+
+	header.Set("traceparent", fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags))
+	header.Set("X-B3-TraceId", sc.TraceID.String())
+	header.Set("X-B3-SpanId", sc.SpanID.String())
+	header.Set("X-B3-Sampled", sampled)
+}
+
+// extractSpanContext returns the span context propagated in header, using either the W3C Trace Context format (tried
+// first) or the B3 single or multiple headers formats.
+func extractSpanContext(header http.Header) (trace.SpanContext, bool) {
+	if v := header.Get("traceparent"); v != "" {
+		parts := strings.Split(strings.TrimSpace(v), "-")
+		if len(parts) >= 4 && len(parts[0]) == 2 && parts[0] != "ff" {
+			return parseSpanContext(parts[1], parts[2], parts[3] == "01" || parts[3] == "03")
+		}
+	}
+
+	if v := header.Get("b3"); v != "" {
+		parts := strings.Split(strings.TrimSpace(v), "-")
+		if len(parts) >= 2 {
+			sampled := len(parts) < 3 || parts[2] == "1" || parts[2] == "d"
+			return parseSpanContext(parts[0], parts[1], sampled)
+		}
+	}
+
+	if header.Get("X-B3-TraceId") != "" {
+		sampled := header.Get("X-B3-Sampled")
+		return parseSpanContext(header.Get("X-B3-TraceId"), header.Get("X-B3-SpanId"),
+			sampled == "" || sampled == "1" || sampled == "true" || header.Get("X-B3-Flags") == "1")
+	}
+
+	return trace.SpanContext{}, false
+}
+
+func parseSpanContext(traceID, spanID string, sampled bool) (trace.SpanContext, bool) {
+	var sc trace.SpanContext
+
+	// B3 trace IDs can be 64-bit long
+	if len(traceID) == 16 {
+		traceID = strings.Repeat("0", 16) + traceID
+	}
+
+	if len(traceID) != 32 || len(spanID) != 16 {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceID)); err != nil || sc.TraceID == (trace.TraceID{}) {
+		return sc, false
+	}
+
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanID)); err != nil || sc.SpanID == (trace.SpanID{}) {
+		return sc, false
+	}
+
+	if sampled {
+		sc.TraceOptions = 1
+	}
+
+	return sc, true
+}
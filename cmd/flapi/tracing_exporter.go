@@ -0,0 +1,417 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/trace"
+)
+
+const (
+	tracingExporterZipkin = "zipkin"
+	tracingExporterOTLP   = "otlp"
+	tracingExporterStdout = "stdout"
+	tracingExporterFile   = "file"
+
+	spanExporterBatchSize     = 100
+	spanExporterFlushInterval = time.Second
+	spanExporterQueueSize     = 1000
+)
+
+// spanExporter is a trace.Exporter flushing its pending spans when closed.
+type spanExporter interface {
+	trace.Exporter
+
+	close()
+}
+
+// newSpanExporters returns the span exporters defined in the tracing configuration.
+func newSpanExporters(config *configTracing) ([]spanExporter, error) {
+	exporters := make([]spanExporter, 0, len(config.Exporters))
+
+	for i := range config.Exporters {
+		e, err := newSpanExporter(&config.Exporters[i], config.ServiceName)
+		if err != nil {
+			closeSpanExporters(exporters)
+			return nil, fmt.Errorf("invalid %q exporter: %s", config.Exporters[i].Type, err)
+		}
+
+		exporters = append(exporters, e)
+	}
+
+	return exporters, nil
+}
+
+func newSpanExporter(config *configTracingExporter, serviceName string) (spanExporter, error) {
+	switch config.Type {
+	case tracingExporterZipkin, tracingExporterOTLP:
+		if config.URL == "" {
+			return nil, fmt.Errorf("URL not specified")
+		}
+
+		encode := encodeZipkinSpans
+		if config.Type == tracingExporterOTLP {
+			encode = encodeOTLPSpans
+		}
+
+		return newHTTPSpanExporter(config.URL, serviceName, encode), nil
+
+	case tracingExporterStdout:
+		return &writerSpanExporter{serviceName: serviceName, w: os.Stdout}, nil
+
+	case tracingExporterFile:
+		if config.Path == "" {
+			return nil, fmt.Errorf("path not specified")
+		}
+
+		f, err := os.OpenFile(config.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		return &writerSpanExporter{serviceName: serviceName, w: f, closer: f}, nil
+
+	case "":
+		return nil, fmt.Errorf("type not specified")
+	}
+
+	return nil, fmt.Errorf("unsupported type")
+}
+
+func closeSpanExporters(exporters []spanExporter) {
+	for _, e := range exporters {
+		e.close()
+	}
+}
+
+// httpSpanExporter sends the spans to a collector HTTP endpoint by batches, in the background.
+type httpSpanExporter struct {
+	url         string
+	serviceName string
+	encode      func(serviceName string, spans []*trace.SpanData) ([]byte, error)
+	client      *http.Client
+	spans       chan *trace.SpanData
+	done        chan struct{}
+}
+
+func newHTTPSpanExporter(url, serviceName string,
+	encode func(string, []*trace.SpanData) ([]byte, error)) *httpSpanExporter {
+	e := httpSpanExporter{
+		url:         url,
+		serviceName: serviceName,
+		encode:      encode,
+		client:      &http.Client{Timeout: 10 * time.Second},
+		spans:       make(chan *trace.SpanData, spanExporterQueueSize),
+		done:        make(chan struct{}),
+	}
+
+	go e.run()
+
+	return &e
+}
+
+func (e *httpSpanExporter) ExportSpan(s *trace.SpanData) {
+	select {
+	case e.spans <- s:
+	default:
+		log.Debug("tracing: exporter queue full, dropping span %s", s.Name)
+	}
+}
+
+func (e *httpSpanExporter) run() {
+	var batch []*trace.SpanData
+
+	ticker := time.NewTicker(spanExporterFlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case s, ok := <-e.spans:
+			if !ok {
+				e.flush(batch)
+				close(e.done)
+				return
+			}
+
+			if batch = append(batch, s); len(batch) >= spanExporterBatchSize {
+				e.flush(batch)
+				batch = nil
+			}
+
+		case <-ticker.C:
+			e.flush(batch)
+			batch = nil
+		}
+	}
+}
+
+func (e *httpSpanExporter) flush(spans []*trace.SpanData) {
+	if len(spans) == 0 {
+		return
+	}
+
+	data, err := e.encode(e.serviceName, spans)
+	if err != nil {
+		log.Error("tracing: unable to encode spans: %s", err)
+		return
+	}
+
+	res, err := e.client.Post(e.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		log.Warning("tracing: unable to export spans to %s: %s", e.url, err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		log.Warning("tracing: unable to export spans to %s: %s", e.url, res.Status)
+	}
+}
+
+func (e *httpSpanExporter) close() {
+	close(e.spans)
+	<-e.done
+}
+
+// writerSpanExporter writes the spans to w in Zipkin JSON format, one span per line.
+type writerSpanExporter struct {
+	serviceName string
+	w           io.Writer
+	closer      io.Closer
+
+	sync.Mutex
+}
+
+func (e *writerSpanExporter) ExportSpan(s *trace.SpanData) {
+	data, err := json.Marshal(newZipkinSpan(e.serviceName, s))
+	if err != nil {
+		log.Error("tracing: unable to encode span: %s", err)
+		return
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	if _, err := e.w.Write(append(data, '\n')); err != nil {
+		log.Warning("tracing: unable to write span: %s", err)
+	}
+}
+
+func (e *writerSpanExporter) close() {
+	if e.closer != nil {
+		e.closer.Close()
+	}
+}
+
+// spanKind returns the kind of the span s along with its attributes, the kind attribute excluded.
+func spanKind(s *trace.SpanData) (string, map[string]interface{}) {
+	kind, _ := s.Attributes[spanKindAttribute].(string)
+
+	attributes := make(map[string]interface{}, len(s.Attributes))
+	for k, v := range s.Attributes {
+		if k != spanKindAttribute {
+			attributes[k] = v
+		}
+	}
+
+	return kind, attributes
+}
+
+// spanServiceName returns the name of the topology service the span s belongs to, or serviceName if it doesn't belong
+// to a topology service.
+func spanServiceName(s *trace.SpanData, serviceName string) string {
+	if name, ok := s.Attributes[spanServiceAttribute].(string); ok {
+		return name
+	}
+
+	return serviceName
+}
+
+// annotationMessage returns the message of the annotation a, followed by its attributes if any.
+func annotationMessage(a trace.Annotation) string {
+	if len(a.Attributes) == 0 {
+		return a.Message
+	}
+
+	attributes := make([]string, 0, len(a.Attributes))
+	for k, v := range a.Attributes {
+		attributes = append(attributes, fmt.Sprintf("%s=%v", k, v))
+	}
+	sort.Strings(attributes)
+
+	return fmt.Sprintf("%s (%s)", a.Message, strings.Join(attributes, ", "))
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name"`
+	Kind          string             `json:"kind,omitempty"`
+	Timestamp     int64              `json:"timestamp"`
+	Duration      int64              `json:"duration"`
+	LocalEndpoint map[string]string  `json:"localEndpoint"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+}
+
+func newZipkinSpan(serviceName string, s *trace.SpanData) *zipkinSpan {
+	kind, attributes := spanKind(s)
+
+	zs := zipkinSpan{
+		TraceID:       s.TraceID.String(),
+		ID:            s.SpanID.String(),
+		Name:          s.Name,
+		Kind:          strings.ToUpper(kind),
+		Timestamp:     s.StartTime.UnixNano() / 1000,
+		Duration:      s.EndTime.Sub(s.StartTime).Nanoseconds() / 1000,
+		LocalEndpoint: map[string]string{"serviceName": spanServiceName(s, serviceName)},
+		Tags:          make(map[string]string, len(attributes)),
+	}
+
+	if s.ParentSpanID != (trace.SpanID{}) {
+		zs.ParentID = s.ParentSpanID.String()
+	}
+
+	for k, v := range attributes {
+		zs.Tags[k] = fmt.Sprint(v)
+	}
+
+	if s.Status.Code != 0 {
+		zs.Tags["error"] = s.Status.Message
+	}
+
+	for _, a := range s.Annotations {
+		zs.Annotations = append(zs.Annotations, zipkinAnnotation{
+			Timestamp: a.Time.UnixNano() / 1000,
+			Value:     annotationMessage(a),
+		})
+	}
+
+	return &zs
+}
+
+// encodeZipkinSpans encodes spans in Zipkin v2 JSON format.
+func encodeZipkinSpans(serviceName string, spans []*trace.SpanData) ([]byte, error) {
+	zs := make([]*zipkinSpan, len(spans))
+	for i := range spans {
+		zs[i] = newZipkinSpan(serviceName, spans[i])
+	}
+
+	return json.Marshal(zs)
+}
+
+// otlpValue returns the OTLP JSON representation of the attribute value v.
+func otlpValue(v interface{}) map[string]interface{} {
+	switch v := v.(type) {
+	case bool:
+		return map[string]interface{}{"boolValue": v}
+	case int64:
+		return map[string]interface{}{"intValue": strconv.FormatInt(v, 10)}
+	}
+
+	return map[string]interface{}{"stringValue": fmt.Sprint(v)}
+}
+
+func otlpAttributes(attributes map[string]interface{}) []map[string]interface{} {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	oa := make([]map[string]interface{}, len(keys))
+	for i, k := range keys {
+		oa[i] = map[string]interface{}{"key": k, "value": otlpValue(attributes[k])}
+	}
+
+	return oa
+}
+
+// encodeOTLPSpans encodes spans in OpenTelemetry protocol (OTLP/HTTP) JSON format.
+func encodeOTLPSpans(serviceName string, spans []*trace.SpanData) ([]byte, error) {
+	var (
+		// Spans are grouped by service, the service name being a resource attribute
+		services     []string
+		serviceSpans = make(map[string][]map[string]interface{})
+	)
+
+	for _, s := range spans {
+		kind, attributes := spanKind(s)
+
+		span := map[string]interface{}{
+			"traceId":           s.TraceID.String(),
+			"spanId":            s.SpanID.String(),
+			"name":              s.Name,
+			"startTimeUnixNano": strconv.FormatInt(s.StartTime.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+			"attributes":        otlpAttributes(attributes),
+			"status":            map[string]interface{}{},
+		}
+
+		if s.ParentSpanID != (trace.SpanID{}) {
+			span["parentSpanId"] = s.ParentSpanID.String()
+		}
+
+		switch kind {
+		case spanKindServer:
+			span["kind"] = 2
+		case spanKindClient:
+			span["kind"] = 3
+		}
+
+		if s.Status.Code != 0 {
+			span["status"] = map[string]interface{}{"code": 2, "message": s.Status.Message}
+		}
+
+		events := make([]map[string]interface{}, len(s.Annotations))
+		for j, a := range s.Annotations {
+			events[j] = map[string]interface{}{
+				"timeUnixNano": strconv.FormatInt(a.Time.UnixNano(), 10),
+				"name":         a.Message,
+				"attributes":   otlpAttributes(a.Attributes),
+			}
+		}
+		span["events"] = events
+
+		name := spanServiceName(s, serviceName)
+		if _, ok := serviceSpans[name]; !ok {
+			services = append(services, name)
+		}
+		serviceSpans[name] = append(serviceSpans[name], span)
+	}
+
+	resourceSpans := make([]interface{}, len(services))
+	for i, name := range services {
+		resourceSpans[i] = map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": otlpAttributes(map[string]interface{}{
+					"service.name": name,
+					"host.name":    hostname,
+				}),
+			},
+			"scopeSpans": []interface{}{
+				map[string]interface{}{
+					"scope": map[string]interface{}{"name": "flapi", "version": version},
+					"spans": serviceSpans[name],
+				},
+			},
+		}
+	}
+
+	return json.Marshal(map[string]interface{}{"resourceSpans": resourceSpans})
+}
@@ -1,12 +1,9 @@
 module flapi
 
 require (
-	github.com/alecthomas/template v0.0.0-20160405071501-a0175ee3bccc // indirect
-	github.com/alecthomas/units v0.0.0-20151022065526-2efee857e7cf // indirect
 	github.com/beorn7/perks v0.0.0-20160804104726-4c0e84591b9a // indirect
 	github.com/facette/httputil v0.0.0-20170428061541-60b4ff39bac2
 	github.com/facette/logger v0.0.0-20180117130157-60ca3a8b846b
-	github.com/falzm/chaos v0.2.0
 	github.com/golang/protobuf v1.0.0 // indirect
 	github.com/gorilla/context v1.1.1 // indirect
 	github.com/gorilla/mux v0.0.0-20180120075819-c0091a029979
@@ -14,15 +11,12 @@ require (
 	github.com/mattn/go-isatty v0.0.4 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/mgutz/ansi v0.0.0-20170206155736-9520e82c474b // indirect
-	github.com/prometheus/client_golang v0.0.0-20180131142826-f4fb1b73fb09 // indirect
+	github.com/prometheus/client_golang v0.0.0-20180131142826-f4fb1b73fb09
 	github.com/prometheus/client_model v0.0.0-20171117100541-99fa1f4be8e5 // indirect
 	github.com/prometheus/common v0.0.0-20180110214958-89604d197083 // indirect
 	github.com/prometheus/procfs v0.0.0-20180125133057-cb4147076ac7 // indirect
 	github.com/urfave/negroni v0.0.0-20180130044549-22c5532ea862
 	go.opencensus.io v0.0.0-20180202205242-7a3c63ab1c57
-	golang.org/x/net v0.0.0-20180202180947-2fb46b16b8dd // indirect
 	golang.org/x/sys v0.0.0-20181030150119-7e31e0c00fa0 // indirect
-	gopkg.in/alecthomas/kingpin.v2 v2.2.6 // indirect
-	gopkg.in/h2non/gentleman.v2 v2.0.3 // indirect
 	gopkg.in/yaml.v2 v2.0.0
 )